@@ -0,0 +1,158 @@
+package animelist
+
+import (
+	"encoding/xml"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Absolute is the default season of the series numbered from their first episode
+const Absolute = "a"
+
+// Load reads the anime-list XML at path
+func Load(path string) (*List, error) {
+	l := &List{path: path}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reload reads the file again, the current mapping is kept when it fails
+func (l *List) Reload() error {
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var list animeList
+	if err := xml.NewDecoder(f).Decode(&list); err != nil {
+		return err
+	}
+	anime := make(map[int]Anime, len(list.Anime))
+	for _, a := range list.Anime {
+		anime[a.AnidbID] = a
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.anime = anime
+	l.modified = info.ModTime()
+	return nil
+}
+
+// RunReload reloads the file whenever it changes, checking every interval
+func (l *List) RunReload(interval time.Duration) {
+	for range time.Tick(interval) {
+		info, err := os.Stat(l.path)
+		if err != nil {
+			log.Printf("Cannot check the anime list: %s", err)
+			continue
+		}
+		l.mu.RLock()
+		modified := l.modified
+		l.mu.RUnlock()
+		if info.ModTime().Equal(modified) {
+			continue
+		}
+		if err := l.Reload(); err != nil {
+			log.Printf("Cannot reload the anime list: %s", err)
+			continue
+		}
+		log.Printf("Reloaded the anime list, %d series", l.Len())
+	}
+}
+
+// Len is the number of series in the list
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.anime)
+}
+
+// Anime finds a series by its AniDB ID
+func (l *List) Anime(anidbID int) (Anime, bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	a, ok := l.anime[anidbID]
+	return a, ok
+}
+
+// Tvdb is the TVDB ID of the series, missing for movies and other releases TVDB doesn't list
+func (a Anime) Tvdb() (int, bool) {
+	id, err := strconv.Atoi(a.TvdbID)
+	return id, err == nil && id > 0
+}
+
+// Tmdb is the TMDB ID of a movie
+func (a Anime) Tmdb() (int, bool) {
+	id, err := strconv.Atoi(a.TmdbID)
+	return id, err == nil && id > 0
+}
+
+// Imdb is the IMDB ID of a movie, the first one when it's split in several parts
+func (a Anime) Imdb() (string, bool) {
+	id := strings.Split(a.ImdbID, ",")[0]
+	return id, strings.HasPrefix(id, "tt")
+}
+
+// Episode maps an AniDB episode, season 1 being the regular episodes and 0 the
+// specials: explicit mappings come first, then the ranges, then the default
+// season of the series with its offset
+func (a Anime) Episode(season, number int) (Episode, bool) {
+	for _, m := range a.Mappings {
+		if m.AnidbSeason != season {
+			continue
+		}
+		if tvdbNumber, ok := m.explicit(number); ok {
+			if tvdbNumber == 0 {
+				// mapped to nothing, TVDB doesn't have it
+				return Episode{}, false
+			}
+			return Episode{Season: m.TvdbSeason, Number: tvdbNumber}, true
+		}
+	}
+	for _, m := range a.Mappings {
+		if m.AnidbSeason == season && m.Start > 0 && number >= m.Start && (m.End == 0 || number <= m.End) {
+			return Episode{Season: m.TvdbSeason, Number: number + m.Offset}, true
+		}
+	}
+	if season != 1 {
+		return Episode{}, false
+	}
+	if a.DefaultTvdbSeason == Absolute {
+		return Episode{Number: number + a.EpisodeOffset, Absolute: true}, true
+	}
+	tvdbSeason, err := strconv.Atoi(a.DefaultTvdbSeason)
+	if err != nil {
+		return Episode{}, false
+	}
+	return Episode{Season: tvdbSeason, Number: number + a.EpisodeOffset}, true
+}
+
+// explicit finds number in the ";anidb-tvdb;" pairs, the first episode is
+// used when it's split on TVDB, e.g. ";3-4+5;"
+func (m Mapping) explicit(number int) (int, bool) {
+	for _, pair := range strings.Split(m.Episodes, ";") {
+		parts := strings.SplitN(strings.TrimSpace(pair), "-", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if anidb, err := strconv.Atoi(parts[0]); err != nil || anidb != number {
+			continue
+		}
+		tvdb, err := strconv.Atoi(strings.Split(parts[1], "+")[0])
+		if err != nil {
+			continue
+		}
+		return tvdb, true
+	}
+	return 0, false
+}
@@ -0,0 +1,105 @@
+package animelist
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testList = `<?xml version="1.0" encoding="UTF-8"?>
+<anime-list>
+  <anime anidbid="23" tvdbid="76885" defaulttvdbseason="1" episodeoffset="" tmdbid="" imdbid="">
+    <name>Cowboy Bebop</name>
+    <mapping-list>
+      <mapping anidbseason="0" tvdbseason="0">;1-1;2-0;</mapping>
+    </mapping-list>
+  </anime>
+  <anime anidbid="4597" tvdbid="79824" defaulttvdbseason="a" episodeoffset="" tmdbid="" imdbid="">
+    <name>Naruto Shippuuden</name>
+  </anime>
+  <anime anidbid="6662" tvdbid="81797" defaulttvdbseason="2" episodeoffset="">
+    <name>One Piece Season 2</name>
+    <mapping-list>
+      <mapping anidbseason="1" tvdbseason="3" start="14" end="26" offset="-13"/>
+      <mapping anidbseason="1" tvdbseason="4">;27-1+2;</mapping>
+    </mapping-list>
+  </anime>
+  <anime anidbid="8" tvdbid="movie" tmdbid="149" imdbid="tt0094625,tt0094626">
+    <name>Akira</name>
+  </anime>
+</anime-list>
+`
+
+func writeList(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "anime-list.xml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestEpisode(t *testing.T) {
+	list, err := Load(writeList(t, testList))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, list.Len())
+
+	bebop, _ := list.Anime(23)
+	tvdb, ok := bebop.Tvdb()
+	assert.True(t, ok)
+	assert.Equal(t, 76885, tvdb)
+	episode, ok := bebop.Episode(1, 5)
+	assert.True(t, ok)
+	assert.Equal(t, Episode{Season: 1, Number: 5}, episode)
+	episode, ok = bebop.Episode(0, 1)
+	assert.True(t, ok)
+	assert.Equal(t, Episode{Season: 0, Number: 1}, episode)
+	_, ok = bebop.Episode(0, 2)
+	assert.False(t, ok)
+	_, ok = bebop.Episode(0, 3)
+	assert.False(t, ok)
+
+	naruto, _ := list.Anime(4597)
+	episode, _ = naruto.Episode(1, 120)
+	assert.Equal(t, Episode{Number: 120, Absolute: true}, episode)
+
+	onePiece, _ := list.Anime(6662)
+	episode, _ = onePiece.Episode(1, 3)
+	assert.Equal(t, Episode{Season: 2, Number: 3}, episode)
+	episode, _ = onePiece.Episode(1, 14)
+	assert.Equal(t, Episode{Season: 3, Number: 1}, episode)
+	episode, _ = onePiece.Episode(1, 27)
+	assert.Equal(t, Episode{Season: 4, Number: 1}, episode)
+
+	akira, _ := list.Anime(8)
+	_, ok = akira.Tvdb()
+	assert.False(t, ok)
+	tmdb, _ := akira.Tmdb()
+	assert.Equal(t, 149, tmdb)
+	imdb, _ := akira.Imdb()
+	assert.Equal(t, "tt0094625", imdb)
+
+	_, ok = list.Anime(1)
+	assert.False(t, ok)
+}
+
+func TestReload(t *testing.T) {
+	path := writeList(t, testList)
+	list, err := Load(path)
+	assert.Nil(t, err)
+
+	assert.Nil(t, list.Reload())
+	go list.RunReload(10 * time.Millisecond)
+	_ = os.WriteFile(path, []byte(`<anime-list><anime anidbid="1" tvdbid="2" defaulttvdbseason="1"/></anime-list>`), 0644)
+	_ = os.Chtimes(path, time.Now(), time.Now().Add(time.Hour))
+	assert.Eventually(t, func() bool { return list.Len() == 1 }, time.Second, 10*time.Millisecond)
+
+	_ = os.WriteFile(path, []byte("<anime-list>"), 0644)
+	assert.NotNil(t, list.Reload())
+	assert.Equal(t, 1, list.Len())
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.xml"))
+	assert.NotNil(t, err)
+}
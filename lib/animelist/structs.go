@@ -0,0 +1,53 @@
+package animelist
+
+import (
+	"sync"
+	"time"
+)
+
+// List is the Anime-Lists mapping of AniDB series to TVDB and TMDB
+type List struct {
+	path     string
+	mu       sync.RWMutex
+	anime    map[int]Anime
+	modified time.Time
+}
+
+// Anime is a series of the list, e.g.
+//
+//	<anime anidbid="23" tvdbid="76885" defaulttvdbseason="1" episodeoffset="" tmdbid="" imdbid="">
+type Anime struct {
+	AnidbID int `xml:"anidbid,attr"`
+	// TvdbID is a number, or the kind of release missing from TVDB such as "movie"
+	TvdbID string `xml:"tvdbid,attr"`
+	// DefaultTvdbSeason is the season of the episodes without mapping, "a" for absolute numbering
+	DefaultTvdbSeason string    `xml:"defaulttvdbseason,attr"`
+	EpisodeOffset     int       `xml:"episodeoffset,attr"`
+	TmdbID            string    `xml:"tmdbid,attr"`
+	ImdbID            string    `xml:"imdbid,attr"`
+	Name              string    `xml:"name"`
+	Mappings          []Mapping `xml:"mapping-list>mapping"`
+}
+
+// Mapping moves episodes of an AniDB season, either the explicit ";anidb-tvdb;"
+// pairs of its text or the start to end range shifted by offset
+type Mapping struct {
+	AnidbSeason int    `xml:"anidbseason,attr"`
+	TvdbSeason  int    `xml:"tvdbseason,attr"`
+	Start       int    `xml:"start,attr"`
+	End         int    `xml:"end,attr"`
+	Offset      int    `xml:"offset,attr"`
+	Episodes    string `xml:",chardata"`
+}
+
+// Episode is the TVDB equivalent of an AniDB episode
+type Episode struct {
+	Season int
+	Number int
+	// Absolute is set when Number counts from the start of the show and Season is unknown
+	Absolute bool
+}
+
+type animeList struct {
+	Anime []Anime `xml:"anime"`
+}
@@ -1,13 +1,47 @@
 package common
 
-import "fmt"
+import (
+	"fmt"
+	"log"
+)
 
 func (body ScrobbleBody) String() string {
 	var title string
 	if body.Movie != nil {
-		title = fmt.Sprintf("%s (%d)", *body.Movie.Title, *body.Movie.Year)
-	} else if body.Show != nil {
-		title = fmt.Sprintf("%s - S%02dE%02d", *body.Show.Title, *body.Episode.Season, *body.Episode.Number)
+		title = fmt.Sprintf("%s (%d)", derefString(body.Movie.Title), derefInt(body.Movie.Year))
+	} else if body.Show != nil && body.Episode != nil {
+		if body.Episode.Season == nil && body.Episode.NumberAbs != nil {
+			title = fmt.Sprintf("%s - E%02d", derefString(body.Show.Title), *body.Episode.NumberAbs)
+		} else {
+			title = fmt.Sprintf("%s - S%02dE%02d", derefString(body.Show.Title), derefInt(body.Episode.Season), derefInt(body.Episode.Number))
+		}
 	}
 	return fmt.Sprintf("%s %d%%", title, body.Progress)
 }
+
+// Safely runs an iteration of a background loop, logging its panic, e.g. from
+// a failing store, instead of letting it stop the process
+func Safely(name string, task func()) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("%s failed: %v", name, err)
+		}
+	}()
+	task()
+}
+
+// derefString and derefInt read the optional fields of the Trakt answers,
+// which only describe the items they recognized
+func derefString(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func derefInt(value *int) int {
+	if value == nil {
+		return 0
+	}
+	return *value
+}
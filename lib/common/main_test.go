@@ -0,0 +1,19 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSafely(t *testing.T) {
+	ran := false
+	assert.NotPanics(t, func() {
+		Safely("Test", func() {
+			ran = true
+			panic(errors.New("store unavailable"))
+		})
+	})
+	assert.True(t, ran)
+}
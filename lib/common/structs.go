@@ -1,5 +1,7 @@
 package common
 
+import "time"
+
 // Ids represent the IDs representing a media item accross the metadata providers
 type Ids struct {
 	Trakt *int    `json:"trakt,omitempty"`
@@ -18,10 +20,12 @@ type Show struct {
 
 // Episode represent an episode
 type Episode struct {
-	Season *int    `json:"season,omitempty"`
-	Number *int    `json:"number,omitempty"`
-	Title  *string `json:"title,omitempty"`
-	Ids    *Ids    `json:"ids,omitempty"`
+	Season *int `json:"season,omitempty"`
+	Number *int `json:"number,omitempty"`
+	// NumberAbs counts the episodes from the start of the show, for the anime numbered that way
+	NumberAbs *int    `json:"number_abs,omitempty"`
+	Title     *string `json:"title,omitempty"`
+	Ids       *Ids    `json:"ids,omitempty"`
 }
 
 // Season represent a season
@@ -47,10 +51,28 @@ type ScrobbleBody struct {
 
 // CacheItem represent an item in cache
 type CacheItem struct {
+	UserID     string       `json:"user_id"`
 	PlayerUuid string       `json:"player_uuid"`
 	ServerUuid string       `json:"server_uuid"`
 	RatingKey  string       `json:"rating_key"`
 	Trigger    string       `json:"trigger"`
 	Body       ScrobbleBody `json:"body"`
 	LastAction string       `json:"last_action"`
+	// Mode is the way LastAction was reported, a scrobble or a check-in
+	Mode string `json:"mode"`
+	// Episodes are the episodes of a file holding several of them, Body is the one at index Part
+	Episodes []Episode `json:"episodes,omitempty"`
+	Part     int       `json:"part"`
+}
+
+// QueueItem represent a failed scrobble waiting to be retried
+type QueueItem struct {
+	ID          string    `json:"id"`
+	Action      string    `json:"action"`
+	Item        CacheItem `json:"item"`
+	Attempts    int       `json:"attempts"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error"`
 }
@@ -3,12 +3,41 @@ package config
 import (
 	"io/ioutil"
 	"os"
+	"strconv"
 	"strings"
 )
 
 var TraktClientId = getConfig("TRAKT_ID")
 var TraktClientSecret = getConfig("TRAKT_SECRET")
 
+// PublicURL is the address of the instance, used when refreshing tokens in the background,
+// the address of the last request is used when it's empty
+var PublicURL = getConfig("PUBLIC_URL")
+
+// TraktAPIURL replaces the Trakt API base URL when set, e.g. to use a staging or fake server
+var TraktAPIURL = getConfig("TRAKT_API_URL")
+
+// ProgressThreshold is the default progress percentage after which a play is watched
+var ProgressThreshold = getIntConfig("PROGRESS_THRESHOLD", 90)
+
+// MaxWebhookSize is the largest webhook body accepted, in bytes
+var MaxWebhookSize = getIntConfig("MAX_WEBHOOK_SIZE", 5*1024*1024)
+
+// WatchedSyncInterval is the delay between two syncs of the Trakt watched history to Plex, in minutes, 0 disables it
+var WatchedSyncInterval = getIntConfig("WATCHED_SYNC_INTERVAL", 60)
+
+// CollectionSyncInterval is the delay between two sweeps of the Trakt collection, in minutes, 0 disables it
+var CollectionSyncInterval = getIntConfig("COLLECTION_SYNC_INTERVAL", 360)
+
+// AnimeListPath is the Anime-Lists XML mapping the AniDB IDs of the HAMA agent, reloaded when it changes
+var AnimeListPath = getConfig("ANIME_LIST_PATH")
+
+// ResolvePlexGuids enables asking Plex for the external IDs of the plex:// items sent without them
+var ResolvePlexGuids = getBoolConfig("RESOLVE_PLEX_GUIDS")
+
+// PlexToken is used to look the plex:// items up on plex.tv for the users without a Plex token in their settings
+var PlexToken = getConfig("PLEX_TOKEN")
+
 func getConfig(name string) string {
 	if os.Getenv(name) != "" {
 		return os.Getenv(name)
@@ -24,3 +53,27 @@ func getConfig(name string) string {
 
 	return ""
 }
+
+func getIntConfig(name string, fallback int64) int64 {
+	value := getConfig(name)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		panic(err)
+	}
+	return i
+}
+
+func getBoolConfig(name string) bool {
+	value := getConfig(name)
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
@@ -0,0 +1,123 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// EmbyWebhook is the payload of Emby's native webhook notifications
+type EmbyWebhook struct {
+	Event string
+	User  struct {
+		Name string
+		Id   string
+	}
+	Server struct {
+		Name string
+		Id   string
+	}
+	Session struct {
+		DeviceId   string
+		DeviceName string
+		Client     string
+	}
+	Item struct {
+		Id                string
+		Name              string
+		Type              string
+		SeriesName        string
+		ParentIndexNumber int
+		IndexNumber       int
+		ProductionYear    int
+		RunTimeTicks      int64
+		ProviderIds       map[string]string
+	}
+	PlaybackInfo struct {
+		PositionTicks      int64
+		PlayedToCompletion bool
+	}
+}
+
+// ParseEmby translates an Emby webhook into a Plex one
+func ParseEmby(body []byte) (Webhook, error) {
+	var wh EmbyWebhook
+	if err := json.Unmarshal(body, &wh); err != nil {
+		return Webhook{}, err
+	}
+	var event string
+	switch wh.Event {
+	case "playback.start":
+		event = EventPlay
+	case "playback.pause":
+		event = EventPause
+	case "playback.unpause":
+		event = EventResume
+	case "playback.stop":
+		if wh.PlaybackInfo.PlayedToCompletion {
+			event = EventScrobble
+		} else {
+			event = EventStop
+		}
+	default:
+		return Webhook{}, fmt.Errorf("unsupported event %q", wh.Event)
+	}
+
+	pr := plexhooks.PlexResponse{
+		Event: event,
+		Owner: true,
+		User:  true,
+		Account: plexhooks.Account{
+			Title: wh.User.Name,
+		},
+		Server: plexhooks.Server{
+			Title: wh.Server.Name,
+			Uuid:  wh.Server.Id,
+		},
+		Player: plexhooks.Player{
+			Title: fmt.Sprintf("%s (%s)", wh.Session.DeviceName, wh.Session.Client),
+			Uuid:  wh.Session.DeviceId,
+		},
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType: librarySectionType(wh.Item.Type),
+			RatingKey:          wh.Item.Id,
+			ExternalGuid:       externalGuids(ProviderIds(wh.Item.ProviderIds)),
+			Type:               strings.ToLower(wh.Item.Type),
+			Title:              wh.Item.Name,
+			GrandparentTitle:   wh.Item.SeriesName,
+			ParentIndex:        wh.Item.ParentIndexNumber,
+			Index:              wh.Item.IndexNumber,
+			Year:               wh.Item.ProductionYear,
+			Duration:           int(wh.Item.RunTimeTicks / ticksPerMillisecond),
+			ViewOffset:         int(wh.PlaybackInfo.PositionTicks / ticksPerMillisecond),
+		},
+	}
+	return Webhook{PlexResponse: pr}, nil
+}
+
+// ProviderIds maps Emby and Jellyfin provider IDs, the keys are case insensitive
+func ProviderIds(providers map[string]string) common.Ids {
+	ids := common.Ids{}
+	for key, value := range providers {
+		switch strings.ToLower(key) {
+		case "tmdb":
+			if id, err := strconv.Atoi(value); err == nil {
+				ids.Tmdb = &id
+			}
+		case "tvdb":
+			if id, err := strconv.Atoi(value); err == nil {
+				ids.Tvdb = &id
+			}
+		case "imdb":
+			if value != "" {
+				imdb := value
+				ids.Imdb = &imdb
+			}
+		}
+	}
+	return ids
+}
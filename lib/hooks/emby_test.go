@@ -0,0 +1,42 @@
+package hooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestParseEmby(t *testing.T) {
+	body := []byte(`{
+		"Event": "playback.stop",
+		"User": {"Name": "halkeye", "Id": "user1"},
+		"Server": {"Name": "emby", "Id": "server1"},
+		"Session": {"DeviceId": "device1", "DeviceName": "TV", "Client": "Emby Theater"},
+		"Item": {
+			"Id": "item1",
+			"Name": "Dr. Strangelove",
+			"Type": "Movie",
+			"ProductionYear": 1964,
+			"RunTimeTicks": 57000000000,
+			"ProviderIds": {"Tmdb": "935", "Imdb": "tt0057012"}
+		},
+		"PlaybackInfo": {"PositionTicks": 56000000000, "PlayedToCompletion": true}
+	}`)
+
+	pr, err := ParseEmby(body)
+	assert.Nil(t, err)
+	assert.Equal(t, EventScrobble, pr.Event)
+	assert.Equal(t, "halkeye", pr.Account.Title)
+	assert.Equal(t, "movie", pr.Metadata.LibrarySectionType)
+	assert.Equal(t, 1964, pr.Metadata.Year)
+	assert.Equal(t, 5700000, pr.Metadata.Duration)
+	assert.ElementsMatch(t, []plexhooks.ExternalGuid{{Id: "tmdb://935"}, {Id: "imdb://tt0057012"}}, pr.Metadata.ExternalGuid)
+}
+
+func TestProviderIds(t *testing.T) {
+	ids := ProviderIds(map[string]string{"Tvdb": "81189", "tmdb": "not a number", "IMDB": "tt0903747"})
+	assert.Equal(t, 81189, *ids.Tvdb)
+	assert.Nil(t, ids.Tmdb)
+	assert.Equal(t, "tt0903747", *ids.Imdb)
+}
@@ -0,0 +1,101 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// JellyfinWebhook is the payload sent by the Jellyfin Webhook plugin with "Send All Properties" enabled
+type JellyfinWebhook struct {
+	NotificationType      string
+	NotificationUsername  string
+	ServerId              string
+	ServerName            string
+	ItemId                string
+	ItemType              string
+	Name                  string
+	SeriesName            string
+	SeasonNumber          int
+	EpisodeNumber         int
+	Year                  int
+	RunTimeTicks          int64
+	PlaybackPositionTicks int64
+	IsPaused              bool
+	PlayedToCompletion    bool
+	DeviceId              string
+	DeviceName            string
+	ClientName            string
+	ProviderTmdb          string `json:"Provider_tmdb"`
+	ProviderTvdb          string `json:"Provider_tvdb"`
+	ProviderImdb          string `json:"Provider_imdb"`
+}
+
+// ParseJellyfin translates a Jellyfin webhook into a Plex one
+func ParseJellyfin(body []byte) (Webhook, error) {
+	var wh JellyfinWebhook
+	if err := json.Unmarshal(body, &wh); err != nil {
+		return Webhook{}, err
+	}
+	var event string
+	switch wh.NotificationType {
+	case "PlaybackStart":
+		event = EventPlay
+	case "PlaybackProgress":
+		if wh.IsPaused {
+			event = EventPause
+		} else {
+			event = EventResume
+		}
+	case "PlaybackStop":
+		if wh.PlayedToCompletion {
+			event = EventScrobble
+		} else {
+			event = EventStop
+		}
+	default:
+		return Webhook{}, fmt.Errorf("unsupported notification type %q", wh.NotificationType)
+	}
+
+	pr := plexhooks.PlexResponse{
+		Event: event,
+		Owner: true,
+		User:  true,
+		Account: plexhooks.Account{
+			Title: wh.NotificationUsername,
+		},
+		Server: plexhooks.Server{
+			Title: wh.ServerName,
+			Uuid:  wh.ServerId,
+		},
+		Player: plexhooks.Player{
+			Title: fmt.Sprintf("%s (%s)", wh.DeviceName, wh.ClientName),
+			Uuid:  wh.DeviceId,
+		},
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType: librarySectionType(wh.ItemType),
+			RatingKey:          wh.ItemId,
+			ExternalGuid:       externalGuids(jellyfinIds(wh)),
+			Type:               strings.ToLower(wh.ItemType),
+			Title:              wh.Name,
+			GrandparentTitle:   wh.SeriesName,
+			ParentIndex:        wh.SeasonNumber,
+			Index:              wh.EpisodeNumber,
+			Year:               wh.Year,
+			Duration:           int(wh.RunTimeTicks / ticksPerMillisecond),
+			ViewOffset:         int(wh.PlaybackPositionTicks / ticksPerMillisecond),
+		},
+	}
+	return Webhook{PlexResponse: pr}, nil
+}
+
+func jellyfinIds(wh JellyfinWebhook) common.Ids {
+	return ProviderIds(map[string]string{
+		"tmdb": wh.ProviderTmdb,
+		"tvdb": wh.ProviderTvdb,
+		"imdb": wh.ProviderImdb,
+	})
+}
@@ -0,0 +1,48 @@
+package hooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestParseJellyfin(t *testing.T) {
+	body := []byte(`{
+		"NotificationType": "PlaybackProgress",
+		"NotificationUsername": "Halkeye",
+		"ServerId": "server1",
+		"ServerName": "jelly",
+		"ItemId": "item1",
+		"ItemType": "Episode",
+		"Name": "Pilot",
+		"SeriesName": "Some Show",
+		"SeasonNumber": 1,
+		"EpisodeNumber": 2,
+		"RunTimeTicks": 30000000000,
+		"PlaybackPositionTicks": 15000000000,
+		"IsPaused": true,
+		"DeviceId": "device1",
+		"DeviceName": "TV",
+		"ClientName": "Jellyfin Web",
+		"Provider_tvdb": "1234",
+		"Provider_imdb": "tt0001"
+	}`)
+
+	pr, err := ParseJellyfin(body)
+	assert.Nil(t, err)
+	assert.Equal(t, EventPause, pr.Event)
+	assert.Equal(t, "Halkeye", pr.Account.Title)
+	assert.Equal(t, "server1", pr.Server.Uuid)
+	assert.Equal(t, "device1", pr.Player.Uuid)
+	assert.Equal(t, "show", pr.Metadata.LibrarySectionType)
+	assert.Equal(t, "item1", pr.Metadata.RatingKey)
+	assert.Equal(t, 3000000, pr.Metadata.Duration)
+	assert.Equal(t, 1500000, pr.Metadata.ViewOffset)
+	assert.Equal(t, []plexhooks.ExternalGuid{{Id: "tvdb://1234"}, {Id: "imdb://tt0001"}}, pr.Metadata.ExternalGuid)
+}
+
+func TestParseJellyfinUnsupported(t *testing.T) {
+	_, err := ParseJellyfin([]byte(`{"NotificationType": "ItemAdded"}`))
+	assert.NotNil(t, err)
+}
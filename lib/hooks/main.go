@@ -0,0 +1,94 @@
+package hooks
+
+import (
+	"fmt"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// Plex event names the other media servers are translated to
+const (
+	EventPlay     = "media.play"
+	EventPause    = "media.pause"
+	EventResume   = "media.resume"
+	EventStop     = "media.stop"
+	EventScrobble = "media.scrobble"
+)
+
+// ticksPerMillisecond converts the .NET ticks used by Jellyfin and Emby
+const ticksPerMillisecond = 10000
+
+// externalGuids builds the Plex style Guid list out of provider IDs
+func externalGuids(ids common.Ids) []plexhooks.ExternalGuid {
+	var guids []plexhooks.ExternalGuid
+	if ids.Tmdb != nil {
+		guids = append(guids, plexhooks.ExternalGuid{Id: fmt.Sprintf("tmdb://%d", *ids.Tmdb)})
+	}
+	if ids.Tvdb != nil {
+		guids = append(guids, plexhooks.ExternalGuid{Id: fmt.Sprintf("tvdb://%d", *ids.Tvdb)})
+	}
+	if ids.Imdb != nil {
+		guids = append(guids, plexhooks.ExternalGuid{Id: fmt.Sprintf("imdb://%s", *ids.Imdb)})
+	}
+	return guids
+}
+
+// librarySectionType maps the item type to the Plex library type
+func librarySectionType(itemType string) string {
+	switch itemType {
+	case "Movie", "movie":
+		return "movie"
+	case "Episode", "episode":
+		return "show"
+	}
+	return ""
+}
+
+// Webhook is a Plex webhook along with the fields plexhooks doesn't decode,
+// the other media servers are translated to it
+type Webhook struct {
+	plexhooks.PlexResponse
+	Extra Extra
+}
+
+// Extra holds the webhook fields missing from plexhooks
+type Extra struct {
+	// Rating is sent with media.rate events
+	Rating   *float32 `json:"rating"`
+	Metadata struct {
+		UserRating *float32 `json:"userRating"`
+		// GrandparentGuid is the guid of the show of an episode
+		GrandparentGuid string  `json:"grandparentGuid"`
+		Media           []Media `json:"Media"`
+	}
+}
+
+// Media is a version of an item, library.new events describe its files
+type Media struct {
+	VideoResolution string `json:"videoResolution"`
+	AudioCodec      string `json:"audioCodec"`
+	AudioChannels   int    `json:"audioChannels"`
+	Part            []Part `json:"Part"`
+}
+
+// Part is a file of a media
+type Part struct {
+	File   string   `json:"file"`
+	Stream []Stream `json:"Stream"`
+}
+
+// Stream is a video, audio or subtitle track of a part
+type Stream struct {
+	StreamType  int    `json:"streamType"`
+	ColorTrc    string `json:"colorTrc"`
+	DOVIPresent bool   `json:"DOVIPresent"`
+}
+
+// UserRating is the 0-10 rating of a media.rate event, nil when it was removed
+func (wh Webhook) UserRating() *float32 {
+	if wh.Extra.Rating != nil {
+		return wh.Extra.Rating
+	}
+	return wh.Extra.Metadata.UserRating
+}
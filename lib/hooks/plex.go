@@ -0,0 +1,56 @@
+package hooks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+// ParsePlex reads the payload part of a Plex multipart/form-data webhook,
+// the thumbnail Plex attaches is skipped without being kept in memory
+func ParsePlex(r *http.Request) (Webhook, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return Webhook{}, errors.New("expected a multipart/form-data request")
+	}
+	if params["boundary"] == "" {
+		return Webhook{}, errors.New("missing multipart boundary")
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	var payload []byte
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return Webhook{}, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		if part.FormName() == "payload" {
+			payload, err = io.ReadAll(part)
+		} else {
+			_, err = io.Copy(io.Discard, part)
+		}
+		_ = part.Close()
+		if err != nil {
+			return Webhook{}, fmt.Errorf("invalid multipart body: %w", err)
+		}
+	}
+	if len(payload) == 0 {
+		return Webhook{}, errors.New("missing payload field")
+	}
+	pr, err := plexhooks.ParseWebhook(payload)
+	if err != nil {
+		return Webhook{}, fmt.Errorf("invalid payload: %w", err)
+	}
+	wh := Webhook{PlexResponse: pr}
+	if err := json.Unmarshal(payload, &wh.Extra); err != nil {
+		return Webhook{}, fmt.Errorf("invalid payload: %w", err)
+	}
+	return wh, nil
+}
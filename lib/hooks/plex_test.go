@@ -0,0 +1,87 @@
+package hooks
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newPlexRequest(t *testing.T, fields map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, value := range fields {
+		if name == "thumb" {
+			part, _ := writer.CreateFormFile(name, "thumb.jpg")
+			_, _ = part.Write([]byte(value))
+		} else {
+			_ = writer.WriteField(name, value)
+		}
+	}
+	_ = writer.Close()
+	r, err := http.NewRequest("POST", "/api?id=id123", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	return r
+}
+
+func TestParsePlex(t *testing.T) {
+	r := newPlexRequest(t, map[string]string{
+		"payload": `{"event":"media.play","Account":{"title":"halkeye"},"Metadata":{"ratingKey":"42"}}`,
+		"thumb":   strings.Repeat("x", 4096),
+	})
+	pr, err := ParsePlex(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "media.play", pr.Event)
+	assert.Equal(t, "halkeye", pr.Account.Title)
+	assert.Equal(t, "42", pr.Metadata.RatingKey)
+}
+
+func TestParsePlexErrors(t *testing.T) {
+	r, _ := http.NewRequest("POST", "/api?id=id123", strings.NewReader("{}"))
+	r.Header.Set("Content-Type", "application/json")
+	_, err := ParsePlex(r)
+	assert.EqualError(t, err, "expected a multipart/form-data request")
+
+	_, err = ParsePlex(newPlexRequest(t, map[string]string{"thumb": "x"}))
+	assert.EqualError(t, err, "missing payload field")
+
+	_, err = ParsePlex(newPlexRequest(t, map[string]string{"payload": "{not json"}))
+	assert.Contains(t, err.Error(), "invalid payload")
+}
+
+func TestParsePlexRating(t *testing.T) {
+	r := newPlexRequest(t, map[string]string{
+		"payload": `{"event":"media.rate","rating":7,"Metadata":{"ratingKey":"42","userRating":6,"grandparentGuid":"com.plexapp.agents.thetvdb://81189?lang=en"}}`,
+	})
+	wh, err := ParsePlex(r)
+	assert.Nil(t, err)
+	assert.Equal(t, float32(7), *wh.UserRating())
+	assert.Equal(t, "com.plexapp.agents.thetvdb://81189?lang=en", wh.Extra.Metadata.GrandparentGuid)
+
+	r = newPlexRequest(t, map[string]string{
+		"payload": `{"event":"media.rate","Metadata":{"ratingKey":"42"}}`,
+	})
+	wh, err = ParsePlex(r)
+	assert.Nil(t, err)
+	assert.Nil(t, wh.UserRating())
+}
+
+func TestParsePlexMedia(t *testing.T) {
+	r := newPlexRequest(t, map[string]string{
+		"payload": `{"event":"library.new","Metadata":{"ratingKey":"42","Media":[{"videoResolution":"1080","audioCodec":"eac3","audioChannels":6,"Part":[{"file":"/movies/Heat.mkv","Stream":[{"streamType":1,"DOVIPresent":true}]}]}]}}`,
+	})
+	wh, err := ParsePlex(r)
+	assert.Nil(t, err)
+	assert.Equal(t, []Media{{
+		VideoResolution: "1080",
+		AudioCodec:      "eac3",
+		AudioChannels:   6,
+		Part:            []Part{{File: "/movies/Heat.mkv", Stream: []Stream{{StreamType: 1, DOVIPresent: true}}}},
+	}}, wh.Extra.Metadata.Media)
+}
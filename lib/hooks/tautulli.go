@@ -0,0 +1,96 @@
+package hooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+// TautulliWebhook is the payload built by the JSON template documented in the README,
+// every value is a string since Tautulli substitutes them as text
+type TautulliWebhook struct {
+	Action          string `json:"action"`
+	User            string `json:"user"`
+	Player          string `json:"player"`
+	MachineId       string `json:"machine_id"`
+	ServerName      string `json:"server_name"`
+	ServerMachineId string `json:"server_machine_id"`
+	RatingKey       string `json:"rating_key"`
+	MediaType       string `json:"media_type"`
+	LibraryName     string `json:"library_name"`
+	Title           string `json:"title"`
+	ShowName        string `json:"show_name"`
+	Year            string `json:"year"`
+	SeasonNum       string `json:"season_num"`
+	EpisodeNum      string `json:"episode_num"`
+	ProgressPercent string `json:"progress_percent"`
+	ImdbId          string `json:"imdb_id"`
+	TmdbId          string `json:"themoviedb_id"`
+	TvdbId          string `json:"thetvdb_id"`
+}
+
+// ParseTautulli translates a Tautulli notification into a Plex webhook
+func ParseTautulli(body []byte) (Webhook, error) {
+	var wh TautulliWebhook
+	if err := json.Unmarshal(body, &wh); err != nil {
+		return Webhook{}, err
+	}
+	var event string
+	switch wh.Action {
+	case "play":
+		event = EventPlay
+	case "pause":
+		event = EventPause
+	case "resume":
+		event = EventResume
+	case "stop":
+		event = EventStop
+	case "watched":
+		event = EventScrobble
+	default:
+		return Webhook{}, fmt.Errorf("unsupported action %q", wh.Action)
+	}
+	// the progress is a percentage, so it is sent as an offset within a 100ms long item
+	progress, _ := strconv.Atoi(wh.ProgressPercent)
+	year, _ := strconv.Atoi(wh.Year)
+	season, _ := strconv.Atoi(wh.SeasonNum)
+	episode, _ := strconv.Atoi(wh.EpisodeNum)
+
+	pr := plexhooks.PlexResponse{
+		Event: event,
+		Owner: true,
+		User:  true,
+		Account: plexhooks.Account{
+			Title: wh.User,
+		},
+		Server: plexhooks.Server{
+			Title: wh.ServerName,
+			Uuid:  wh.ServerMachineId,
+		},
+		Player: plexhooks.Player{
+			Title: wh.Player,
+			Uuid:  wh.MachineId,
+		},
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType:  librarySectionType(wh.MediaType),
+			LibrarySectionTitle: wh.LibraryName,
+			RatingKey:           wh.RatingKey,
+			ExternalGuid: externalGuids(ProviderIds(map[string]string{
+				"tmdb": wh.TmdbId,
+				"tvdb": wh.TvdbId,
+				"imdb": wh.ImdbId,
+			})),
+			Type:             wh.MediaType,
+			Title:            wh.Title,
+			GrandparentTitle: wh.ShowName,
+			ParentIndex:      season,
+			Index:            episode,
+			Year:             year,
+			Duration:         100,
+			ViewOffset:       progress,
+		},
+	}
+	return Webhook{PlexResponse: pr}, nil
+}
@@ -0,0 +1,41 @@
+package hooks
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestParseTautulli(t *testing.T) {
+	body := []byte(`{
+		"action": "watched",
+		"user": "halkeye",
+		"player": "Living Room",
+		"machine_id": "player1",
+		"server_name": "plex",
+		"server_machine_id": "server1",
+		"rating_key": "1234",
+		"media_type": "episode",
+		"library_name": "TV Shows",
+		"title": "Pilot",
+		"show_name": "Breaking Bad",
+		"year": "2008",
+		"season_num": "1",
+		"episode_num": "1",
+		"progress_percent": "93",
+		"imdb_id": "",
+		"themoviedb_id": "",
+		"thetvdb_id": "349232"
+	}`)
+
+	pr, err := ParseTautulli(body)
+	assert.Nil(t, err)
+	assert.Equal(t, EventScrobble, pr.Event)
+	assert.Equal(t, "player1", pr.Player.Uuid)
+	assert.Equal(t, "show", pr.Metadata.LibrarySectionType)
+	assert.Equal(t, "TV Shows", pr.Metadata.LibrarySectionTitle)
+	assert.Equal(t, 93, pr.Metadata.ViewOffset)
+	assert.Equal(t, 100, pr.Metadata.Duration)
+	assert.Equal(t, []plexhooks.ExternalGuid{{Id: "tvdb://349232"}}, pr.Metadata.ExternalGuid)
+}
@@ -0,0 +1,97 @@
+package plex
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+// MetadataProviderURL is the plex.tv service describing the items of the Plex agents
+const MetadataProviderURL = "https://metadata.provider.plex.tv"
+
+// New creates a client for the server at serverURL, e.g. http://10.20.30.40:32400
+func New(serverURL, token string) *Client {
+	return &Client{
+		URL:        strings.TrimRight(serverURL, "/"),
+		token:      token,
+		httpClient: &http.Client{Timeout: time.Second * 30},
+	}
+}
+
+// Sections lists the libraries of the server
+func (c *Client) Sections() ([]Section, error) {
+	var container mediaContainer
+	err := c.get("/library/sections", nil, &container)
+	return container.MediaContainer.Directory, err
+}
+
+// Items lists the movies or shows of a library along with their Guids
+func (c *Client) Items(sectionKey string) ([]plexhooks.Metadata, error) {
+	var container mediaContainer
+	err := c.get(fmt.Sprintf("/library/sections/%s/all", url.PathEscape(sectionKey)), url.Values{"includeGuids": {"1"}}, &container)
+	return container.MediaContainer.Metadata, err
+}
+
+// Episodes lists every episode of a show
+func (c *Client) Episodes(showRatingKey string) ([]plexhooks.Metadata, error) {
+	var container mediaContainer
+	err := c.get(fmt.Sprintf("/library/metadata/%s/allLeaves", url.PathEscape(showRatingKey)), url.Values{"includeGuids": {"1"}}, &container)
+	return container.MediaContainer.Metadata, err
+}
+
+// Metadata describes an item along with its Guids, ratingKey is the id of a
+// plex:// guid when the client points at MetadataProviderURL
+func (c *Client) Metadata(ratingKey string) (plexhooks.Metadata, error) {
+	var container mediaContainer
+	err := c.get(fmt.Sprintf("/library/metadata/%s", url.PathEscape(ratingKey)), url.Values{"includeGuids": {"1"}}, &container)
+	if err != nil {
+		return plexhooks.Metadata{}, err
+	}
+	if len(container.MediaContainer.Metadata) == 0 {
+		return plexhooks.Metadata{}, fmt.Errorf("item %s not found", ratingKey)
+	}
+	return container.MediaContainer.Metadata[0], nil
+}
+
+// MarkPlayed marks an item as played for the owner of the token
+func (c *Client) MarkPlayed(ratingKey string) error {
+	return c.get("/:/scrobble", url.Values{
+		"identifier": {"com.plexapp.plugins.library"},
+		"key":        {ratingKey},
+	}, nil)
+}
+
+// get calls the server and decodes the JSON response in out when it isn't nil
+func (c *Client) get(path string, query url.Values, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, c.URL+path, nil)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("X-Plex-Token", c.token)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status code: %d", path, resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
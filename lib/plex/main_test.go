@@ -0,0 +1,69 @@
+package plex
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newFakeServer(t *testing.T, played *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Plex-Token") != "token123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/library/sections":
+			fmt.Fprint(w, `{"MediaContainer":{"Directory":[{"key":"1","title":"Movies","type":"movie"}]}}`)
+		case "/library/sections/1/all":
+			assert.Equal(t, "1", r.URL.Query().Get("includeGuids"))
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"10","type":"movie","viewCount":0,"Guid":[{"id":"tmdb://935"}]}]}}`)
+		case "/library/metadata/10":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"10","guid":"plex://movie/5d776","Guid":[{"id":"tmdb://935"}]}]}}`)
+		case "/library/metadata/20/allLeaves":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"21","type":"episode","parentIndex":1,"index":2}]}}`)
+		case "/:/scrobble":
+			*played = append(*played, r.URL.Query().Get("key"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestClient(t *testing.T) {
+	var played []string
+	srv := newFakeServer(t, &played)
+	defer srv.Close()
+	client := New(srv.URL+"/", "token123")
+
+	sections, err := client.Sections()
+	assert.Nil(t, err)
+	assert.Equal(t, []Section{{Key: "1", Title: "Movies", Type: "movie"}}, sections)
+
+	items, err := client.Items("1")
+	assert.Nil(t, err)
+	assert.Len(t, items, 1)
+	assert.Equal(t, "10", items[0].RatingKey)
+	assert.Equal(t, "tmdb://935", items[0].ExternalGuid[0].Id)
+
+	episodes, err := client.Episodes("20")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, episodes[0].ParentIndex)
+	assert.Equal(t, 2, episodes[0].Index)
+
+	item, err := client.Metadata("10")
+	assert.Nil(t, err)
+	assert.Equal(t, "plex://movie/5d776", item.Guid)
+	assert.Equal(t, "tmdb://935", item.ExternalGuid[0].Id)
+	_, err = client.Metadata("11")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, client.MarkPlayed("10"))
+	assert.Equal(t, []string{"10"}, played)
+
+	_, err = New(srv.URL, "wrong").Sections()
+	assert.NotNil(t, err)
+}
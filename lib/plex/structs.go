@@ -0,0 +1,28 @@
+package plex
+
+import (
+	"net/http"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+// Client talks to a Plex Media Server
+type Client struct {
+	URL        string
+	token      string
+	httpClient *http.Client
+}
+
+// Section is a library of a server
+type Section struct {
+	Key   string `json:"key"`
+	Title string `json:"title"`
+	Type  string `json:"type"`
+}
+
+type mediaContainer struct {
+	MediaContainer struct {
+		Directory []Section
+		Metadata  []plexhooks.Metadata
+	}
+}
@@ -2,14 +2,17 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
-	"time"
 
 	"github.com/peterbourgon/diskv"
 	"github.com/xanderstrike/goplaxt/lib/common"
 )
 
+const queuePrefix = "queue."
+
 // DiskStore is a storage engine that writes to the disk
 type DiskStore struct{}
 
@@ -29,7 +32,19 @@ func (s DiskStore) WriteUser(user User) {
 	s.writeField(user.ID, "username", user.Username)
 	s.writeField(user.ID, "access", user.AccessToken)
 	s.writeField(user.ID, "refresh", user.RefreshToken)
-	s.writeField(user.ID, "updated", user.Updated.Format("01-02-2006"))
+	s.writeField(user.ID, "secret", user.Secret)
+	s.writeField(user.ID, "filters", encodeFilters(user.Filters))
+	s.writeField(user.ID, "movie_threshold", strconv.Itoa(user.MovieThreshold))
+	s.writeField(user.ID, "episode_threshold", strconv.Itoa(user.EpisodeThreshold))
+	s.writeField(user.ID, "plex_url", user.PlexURL)
+	s.writeField(user.ID, "plex_token", user.PlexToken)
+	s.writeField(user.ID, "watched_sync", strconv.FormatBool(user.WatchedSync))
+	s.writeField(user.ID, "collection_sync", strconv.FormatBool(user.CollectionSync))
+	s.writeField(user.ID, "watchlist_cleanup", strconv.FormatBool(user.WatchlistCleanup))
+	s.writeField(user.ID, "mode", user.Mode)
+	s.writeField(user.ID, "updated", formatTime(user.Updated))
+	s.writeField(user.ID, "expires", formatTime(user.Expires))
+	s.writeField(user.ID, "needs_reauth", strconv.FormatBool(user.NeedsReauth))
 }
 
 // GetUser will load a user from disk
@@ -50,13 +65,40 @@ func (s DiskStore) GetUser(id string) *User {
 	if err != nil {
 		return nil
 	}
-	updated, _ := time.Parse("01-02-2006", ud)
+	// users created before these settings existed don't have them
+	secret, _ := s.readField(id, "secret")
+	filters, _ := s.readField(id, "filters")
+	movieThreshold, _ := s.readField(id, "movie_threshold")
+	episodeThreshold, _ := s.readField(id, "episode_threshold")
+	plexURL, _ := s.readField(id, "plex_url")
+	plexToken, _ := s.readField(id, "plex_token")
+	watchedSync, _ := s.readField(id, "watched_sync")
+	collectionSync, _ := s.readField(id, "collection_sync")
+	watchlistCleanup, _ := s.readField(id, "watchlist_cleanup")
+	mode, _ := s.readField(id, "mode")
+	expires, _ := s.readField(id, "expires")
+	needsReauth, _ := s.readField(id, "needs_reauth")
 	user := User{
 		ID:           id,
 		Username:     strings.ToLower(un),
 		AccessToken:  ac,
 		RefreshToken: re,
-		Updated:      updated,
+		Secret:       secret,
+		Updated:      parseTime(ud),
+		Expires:      parseTime(expires),
+		NeedsReauth:  parseBool(needsReauth),
+		Settings: Settings{
+			Filters:          decodeFilters(filters),
+			MovieThreshold:   atoi(movieThreshold),
+			EpisodeThreshold: atoi(episodeThreshold),
+			PlexURL:          plexURL,
+			PlexToken:        plexToken,
+			WatchedSync:      parseBool(watchedSync),
+			CollectionSync:   parseBool(collectionSync),
+			WatchlistCleanup: parseBool(watchlistCleanup),
+			Mode:             mode,
+		},
+		store: s,
 	}
 
 	return &user
@@ -67,11 +109,43 @@ func (s DiskStore) GetUserByName(username string) *User {
 	return nil
 }
 
+// ListUsers will load every user from disk
+func (s DiskStore) ListUsers() []User {
+	var users []User
+	for _, key := range s.keys("") {
+		if !strings.HasSuffix(key, ".username") {
+			continue
+		}
+		if user := s.GetUser(strings.TrimSuffix(key, ".username")); user != nil {
+			users = append(users, *user)
+		}
+	}
+	return users
+}
+
+// DeleteUser will delete a user from disk, along with their queued scrobbles
 func (s DiskStore) DeleteUser(id, username string) bool {
 	s.eraseField(id, "username")
 	s.eraseField(id, "updated")
+	s.eraseField(id, "expires")
+	s.eraseField(id, "needs_reauth")
 	s.eraseField(id, "access")
 	s.eraseField(id, "refresh")
+	s.eraseField(id, "secret")
+	s.eraseField(id, "filters")
+	s.eraseField(id, "movie_threshold")
+	s.eraseField(id, "episode_threshold")
+	s.eraseField(id, "plex_url")
+	s.eraseField(id, "plex_token")
+	s.eraseField(id, "watched_sync")
+	s.eraseField(id, "collection_sync")
+	s.eraseField(id, "watchlist_cleanup")
+	s.eraseField(id, "mode")
+	for _, item := range s.GetScrobbleQueue() {
+		if item.Item.UserID == id {
+			s.DequeueScrobble(item.ID)
+		}
+	}
 	return true
 }
 
@@ -86,6 +160,36 @@ func (s DiskStore) GetScrobbleBody(playerUuid, ratingKey string) common.CacheIte
 func (s DiskStore) WriteScrobbleBody(item common.CacheItem) {
 }
 
+// EnqueueScrobble will write a failed scrobble to disk
+func (s DiskStore) EnqueueScrobble(item common.QueueItem) {
+	b, _ := json.Marshal(item)
+	err := s.write(queuePrefix+item.ID, string(b))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// GetScrobbleQueue will load all the failed scrobbles from disk
+func (s DiskStore) GetScrobbleQueue() []common.QueueItem {
+	var items []common.QueueItem
+	for _, key := range s.keys(queuePrefix) {
+		value, err := s.read(key)
+		if err != nil {
+			continue
+		}
+		var item common.QueueItem
+		if json.Unmarshal([]byte(value), &item) == nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DequeueScrobble will remove a failed scrobble from disk
+func (s DiskStore) DequeueScrobble(id string) {
+	_ = s.erase(queuePrefix + id)
+}
+
 func (s DiskStore) writeField(id, field, value string) {
 	err := s.write(fmt.Sprintf("%s.%s", id, field), value)
 	if err != nil {
@@ -98,12 +202,16 @@ func (s DiskStore) readField(id, field string) (string, error) {
 }
 
 func (s DiskStore) eraseField(id, field string) error {
+	return s.erase(fmt.Sprintf("%s.%s", id, field))
+}
+
+func (s DiskStore) erase(key string) error {
 	d := diskv.New(diskv.Options{
 		BasePath:     "keystore",
 		Transform:    flatTransform,
 		CacheSizeMax: 1024 * 1024,
 	})
-	return d.Erase(fmt.Sprintf("%s.%s", id, field))
+	return d.Erase(key)
 }
 
 func (s DiskStore) write(key, value string) error {
@@ -124,3 +232,16 @@ func (s DiskStore) read(key string) (string, error) {
 	value, err := d.Read(key)
 	return string(value), err
 }
+
+func (s DiskStore) keys(prefix string) []string {
+	d := diskv.New(diskv.Options{
+		BasePath:     "keystore",
+		Transform:    flatTransform,
+		CacheSizeMax: 1024 * 1024,
+	})
+	var keys []string
+	for key := range d.KeysPrefix(prefix, nil) {
+		keys = append(keys, key)
+	}
+	return keys
+}
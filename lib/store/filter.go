@@ -0,0 +1,71 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Fields a Filter can match on
+const (
+	FilterServer  = "server"
+	FilterLibrary = "library"
+	FilterPlayer  = "player"
+	FilterAccount = "account"
+)
+
+// Filter is a rule ignoring the webhooks whose field equals value
+type Filter struct {
+	Field string `json:"field"`
+	Value string `json:"value"`
+}
+
+func (f Filter) String() string {
+	return fmt.Sprintf("%s=%s", f.Field, f.Value)
+}
+
+// ParseFilters reads one "field=value" rule per line
+func ParseFilters(text string) ([]Filter, error) {
+	var filters []Filter
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, fmt.Errorf("invalid rule %q, expected field=value", line)
+		}
+		field := strings.ToLower(strings.TrimSpace(parts[0]))
+		switch field {
+		case FilterServer, FilterLibrary, FilterPlayer, FilterAccount:
+		default:
+			return nil, fmt.Errorf("invalid field %q, expected one of server, library, player, account", field)
+		}
+		filters = append(filters, Filter{Field: field, Value: strings.TrimSpace(parts[1])})
+	}
+	return filters, nil
+}
+
+// FormatFilters writes the rules back in the format read by ParseFilters
+func FormatFilters(filters []Filter) string {
+	lines := make([]string, len(filters))
+	for i, f := range filters {
+		lines[i] = f.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func encodeFilters(filters []Filter) string {
+	if len(filters) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(filters)
+	return string(b)
+}
+
+func decodeFilters(value string) []Filter {
+	var filters []Filter
+	_ = json.Unmarshal([]byte(value), &filters)
+	return filters
+}
@@ -0,0 +1,29 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFilters(t *testing.T) {
+	filters, err := ParseFilters("library = Kids\n\nPlayer=Living Room TV\n")
+	assert.Nil(t, err)
+	assert.Equal(t, []Filter{
+		{Field: FilterLibrary, Value: "Kids"},
+		{Field: FilterPlayer, Value: "Living Room TV"},
+	}, filters)
+	assert.Equal(t, "library=Kids\nplayer=Living Room TV", FormatFilters(filters))
+
+	_, err = ParseFilters("genre=Horror")
+	assert.NotNil(t, err)
+	_, err = ParseFilters("library")
+	assert.NotNil(t, err)
+}
+
+func TestEncodeFilters(t *testing.T) {
+	filters := []Filter{{Field: FilterServer, Value: "abc"}}
+	assert.Equal(t, filters, decodeFilters(encodeFilters(filters)))
+	assert.Equal(t, "", encodeFilters(nil))
+	assert.Nil(t, decodeFilters(""))
+}
@@ -2,6 +2,8 @@ package store
 
 import (
 	"context"
+	"strconv"
+	"time"
 
 	"github.com/xanderstrike/goplaxt/lib/common"
 )
@@ -11,11 +13,42 @@ type Store interface {
 	WriteUser(user User)
 	GetUser(id string) *User
 	GetUserByName(username string) *User
+	ListUsers() []User
 	DeleteUser(id, username string) bool
 	GetScrobbleBody(playerUuid, ratingKey string) common.CacheItem
 	WriteScrobbleBody(item common.CacheItem)
+	EnqueueScrobble(item common.QueueItem)
+	GetScrobbleQueue() []common.QueueItem
+	DequeueScrobble(id string)
 	Ping(ctx context.Context) error
 }
 
 // Utils
 func flatTransform(s string) []string { return []string{} }
+
+// parseBool reads the booleans stored as strings, missing values are false
+func parseBool(s string) bool {
+	b, _ := strconv.ParseBool(s)
+	return b
+}
+
+// formatTime writes a timestamp with its full precision
+func formatTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+// parseTime reads the timestamps written by formatTime, and the dates stored
+// before them, missing values are the zero time
+func parseTime(s string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t
+	}
+	t, _ := time.Parse("01-02-2006", s)
+	return t
+}
+
+// atoi reads the integers stored as strings, missing values are 0
+func atoi(s string) int {
+	i, _ := strconv.Atoi(s)
+	return i
+}
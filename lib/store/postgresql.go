@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -13,6 +14,38 @@ import (
 	"github.com/xanderstrike/goplaxt/lib/common"
 )
 
+var schema = []string{
+	`
+		CREATE TABLE IF NOT EXISTS users (
+			id varchar(255) NOT NULL,
+			username varchar(255) NOT NULL,
+			access varchar(255) NOT NULL,
+			refresh varchar(255) NOT NULL,
+			updated timestamp with time zone NOT NULL,
+			PRIMARY KEY(id)
+		)
+	`,
+	`
+		CREATE TABLE IF NOT EXISTS scrobble_queue (
+			id varchar(255) NOT NULL,
+			item text NOT NULL,
+			PRIMARY KEY(id)
+		)
+	`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS secret varchar(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS filters text NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS movie_threshold integer NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS episode_threshold integer NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS plex_url varchar(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS plex_token varchar(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS watched_sync boolean NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS collection_sync boolean NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS watchlist_cleanup boolean NOT NULL DEFAULT false`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS mode varchar(255) NOT NULL DEFAULT ''`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS expires timestamp with time zone`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS needs_reauth boolean NOT NULL DEFAULT false`,
+}
+
 // PostgresqlStore is a storage engine that writes to postgres
 type PostgresqlStore struct {
 	db *sql.DB
@@ -24,19 +57,11 @@ func NewPostgresqlClient(connStr string) *sql.DB {
 	if err != nil {
 		panic(err)
 	}
-	rows, err := db.Query(`
-		CREATE TABLE IF NOT EXISTS users (
-			id varchar(255) NOT NULL,
-			username varchar(255) NOT NULL,
-			access varchar(255) NOT NULL,
-			refresh varchar(255) NOT NULL,
-			updated timestamp with time zone NOT NULL,
-			PRIMARY KEY(id)
-		)
-	`)
-	defer rows.Close()
-	if err != nil {
-		panic(err)
+	for _, query := range schema {
+		_, err = db.Exec(query)
+		if err != nil {
+			panic(err)
+		}
 	}
 
 	return db
@@ -65,16 +90,34 @@ func (s PostgresqlStore) WriteUser(user User) {
 	_, err := s.db.Exec(
 		`
 			INSERT INTO users
-				(id, username, access, refresh, updated)
-				VALUES($1, $2, $3, $4, $5)
+				(id, username, access, refresh, secret, filters, movie_threshold, episode_threshold, plex_url, plex_token,
+				watched_sync, collection_sync, watchlist_cleanup, mode, updated, expires, needs_reauth)
+				VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
 			ON CONFLICT(id)
-			DO UPDATE set username=EXCLUDED.username, access=EXCLUDED.access, refresh=EXCLUDED.refresh, updated=EXCLUDED.updated
+			DO UPDATE set username=EXCLUDED.username, access=EXCLUDED.access, refresh=EXCLUDED.refresh, secret=EXCLUDED.secret,
+				filters=EXCLUDED.filters, movie_threshold=EXCLUDED.movie_threshold, episode_threshold=EXCLUDED.episode_threshold,
+				plex_url=EXCLUDED.plex_url, plex_token=EXCLUDED.plex_token, watched_sync=EXCLUDED.watched_sync,
+				collection_sync=EXCLUDED.collection_sync, watchlist_cleanup=EXCLUDED.watchlist_cleanup,
+				mode=EXCLUDED.mode, updated=EXCLUDED.updated, expires=EXCLUDED.expires,
+				needs_reauth=EXCLUDED.needs_reauth
 		`,
 		user.ID,
 		user.Username,
 		user.AccessToken,
 		user.RefreshToken,
+		user.Secret,
+		encodeFilters(user.Filters),
+		user.MovieThreshold,
+		user.EpisodeThreshold,
+		user.PlexURL,
+		user.PlexToken,
+		user.WatchedSync,
+		user.CollectionSync,
+		user.WatchlistCleanup,
+		user.Mode,
 		user.Updated,
+		sql.NullTime{Time: user.Expires, Valid: !user.Expires.IsZero()},
+		user.NeedsReauth,
 	)
 	if err != nil {
 		panic(err)
@@ -86,20 +129,49 @@ func (s PostgresqlStore) GetUser(id string) *User {
 	var username string
 	var access string
 	var refresh string
+	var secret string
+	var filters string
+	var movieThreshold int
+	var episodeThreshold int
+	var plexURL string
+	var plexToken string
+	var watchedSync bool
+	var collectionSync bool
+	var watchlistCleanup bool
+	var mode string
 	var updated time.Time
+	var expires sql.NullTime
+	var needsReauth bool
 
 	err := s.db.QueryRow(
-		"SELECT username, access, refresh, updated FROM users WHERE id=$1",
+		`
+			SELECT username, access, refresh, secret, filters, movie_threshold, episode_threshold, plex_url, plex_token,
+				watched_sync, collection_sync, watchlist_cleanup, mode, updated, expires,
+				needs_reauth
+			FROM users WHERE id=$1
+		`,
 		id,
 	).Scan(
 		&username,
 		&access,
 		&refresh,
+		&secret,
+		&filters,
+		&movieThreshold,
+		&episodeThreshold,
+		&plexURL,
+		&plexToken,
+		&watchedSync,
+		&collectionSync,
+		&watchlistCleanup,
+		&mode,
 		&updated,
+		&expires,
+		&needsReauth,
 	)
 	switch {
 	case err == sql.ErrNoRows:
-		panic(fmt.Errorf("no user with id %s", id))
+		return nil
 	case err != nil:
 		panic(fmt.Errorf("query error: %v", err))
 	}
@@ -108,8 +180,22 @@ func (s PostgresqlStore) GetUser(id string) *User {
 		Username:     strings.ToLower(username),
 		AccessToken:  access,
 		RefreshToken: refresh,
+		Secret:       secret,
 		Updated:      updated,
-		store:        s,
+		Expires:      expires.Time,
+		NeedsReauth:  needsReauth,
+		Settings: Settings{
+			Filters:          decodeFilters(filters),
+			MovieThreshold:   movieThreshold,
+			EpisodeThreshold: episodeThreshold,
+			PlexURL:          plexURL,
+			PlexToken:        plexToken,
+			WatchedSync:      watchedSync,
+			CollectionSync:   collectionSync,
+			WatchlistCleanup: watchlistCleanup,
+			Mode:             mode,
+		},
+		store: s,
 	}
 
 	return &user
@@ -120,9 +206,44 @@ func (s PostgresqlStore) GetUserByName(username string) *User {
 	return nil
 }
 
-// TODO: Not Implemented
+// ListUsers will load every user from postgres
+func (s PostgresqlStore) ListUsers() []User {
+	rows, err := s.db.Query("SELECT id FROM users")
+	if err != nil {
+		return nil
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if rows.Scan(&id) == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+	var users []User
+	for _, id := range ids {
+		if user := s.GetUser(id); user != nil {
+			users = append(users, *user)
+		}
+	}
+	return users
+}
+
+// DeleteUser will delete a user from postgres, along with their queued scrobbles
 func (s PostgresqlStore) DeleteUser(id, username string) bool {
-	return true
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false
+	}
+	_, err = tx.Exec("DELETE FROM users WHERE id=$1", id)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM scrobble_queue WHERE item::jsonb->'item'->>'user_id'=$1", id)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return false
+	}
+	return tx.Commit() == nil
 }
 
 func (s PostgresqlStore) GetScrobbleBody(playerUuid, ratingKey string) common.CacheItem {
@@ -135,3 +256,48 @@ func (s PostgresqlStore) GetScrobbleBody(playerUuid, ratingKey string) common.Ca
 
 func (s PostgresqlStore) WriteScrobbleBody(item common.CacheItem) {
 }
+
+// EnqueueScrobble will write a failed scrobble to postgres
+func (s PostgresqlStore) EnqueueScrobble(item common.QueueItem) {
+	b, _ := json.Marshal(item)
+	_, err := s.db.Exec(
+		`
+			INSERT INTO scrobble_queue
+				(id, item)
+				VALUES($1, $2)
+			ON CONFLICT(id)
+			DO UPDATE set item=EXCLUDED.item
+		`,
+		item.ID,
+		string(b),
+	)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// GetScrobbleQueue will load all the failed scrobbles from postgres
+func (s PostgresqlStore) GetScrobbleQueue() []common.QueueItem {
+	rows, err := s.db.Query("SELECT item FROM scrobble_queue")
+	if err != nil {
+		return nil
+	}
+	defer rows.Close()
+	var items []common.QueueItem
+	for rows.Next() {
+		var value string
+		if rows.Scan(&value) != nil {
+			continue
+		}
+		var item common.QueueItem
+		if json.Unmarshal([]byte(value), &item) == nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DequeueScrobble will remove a failed scrobble from postgres
+func (s PostgresqlStore) DequeueScrobble(id string) {
+	_, _ = s.db.Exec("DELETE FROM scrobble_queue WHERE id=$1", id)
+}
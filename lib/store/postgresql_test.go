@@ -1,6 +1,7 @@
 package store
 
 import (
+	"database/sql"
 	"encoding/json"
 	"testing"
 	"time"
@@ -17,16 +18,28 @@ func TestPostgresqlLoadingUser(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectQuery(
-		"SELECT username, access, refresh, updated FROM users WHERE id=.*",
+		"SELECT username, access, refresh, secret, filters, movie_threshold, episode_threshold, plex_url, plex_token,\\s+watched_sync, collection_sync, watchlist_cleanup, mode, updated, expires,\\s+needs_reauth\\s+FROM users WHERE id=.*",
 	).WithArgs(
 		"id123",
 	).WillReturnRows(
-		sqlmock.NewRows([]string{"username", "access", "refresh", "updated"}).
+		sqlmock.NewRows([]string{"username", "access", "refresh", "secret", "filters", "movie_threshold", "episode_threshold", "plex_url", "plex_token", "watched_sync", "collection_sync", "watchlist_cleanup", "mode", "updated", "expires", "needs_reauth"}).
 			AddRow(
 				"halkeye",
 				"access123",
 				"refresh123",
+				"secret123",
+				`[{"field":"library","value":"Kids"}]`,
+				85,
+				95,
+				"http://plex:32400",
+				"plex123",
+				true,
+				false,
+				true,
+				"checkin",
 				time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+				time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC),
+				true,
 			),
 	)
 
@@ -37,7 +50,20 @@ func TestPostgresqlLoadingUser(t *testing.T) {
 		Username:     "halkeye",
 		AccessToken:  "access123",
 		RefreshToken: "refresh123",
+		Secret:       "secret123",
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+		Expires:      time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC),
+		NeedsReauth:  true,
+		Settings: Settings{
+			Filters:          []Filter{{Field: FilterLibrary, Value: "Kids"}},
+			MovieThreshold:   85,
+			EpisodeThreshold: 95,
+			PlexURL:          "http://plex:32400",
+			PlexToken:        "plex123",
+			WatchedSync:      true,
+			WatchlistCleanup: true,
+			Mode:             ModeCheckin,
+		},
 	})
 	actual, _ := json.Marshal(store.GetUser("id123"))
 
@@ -53,12 +79,24 @@ func TestPostgresqlSavingUser(t *testing.T) {
 
 	mock.ExpectExec("INSERT INTO ").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectQuery("SELECT").WithArgs("id123").WillReturnRows(
-		sqlmock.NewRows([]string{"username", "access", "refresh", "updated"}).
+		sqlmock.NewRows([]string{"username", "access", "refresh", "secret", "filters", "movie_threshold", "episode_threshold", "plex_url", "plex_token", "watched_sync", "collection_sync", "watchlist_cleanup", "mode", "updated", "expires", "needs_reauth"}).
 			AddRow(
 				"halkeye",
 				"access123",
 				"refresh123",
+				"secret123",
+				`[{"field":"library","value":"Kids"}]`,
+				85,
+				95,
+				"http://plex:32400",
+				"plex123",
+				true,
+				false,
+				true,
+				"checkin",
 				time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+				time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC),
+				true,
 			),
 	)
 
@@ -68,8 +106,21 @@ func TestPostgresqlSavingUser(t *testing.T) {
 		Username:     "halkeye",
 		AccessToken:  "access123",
 		RefreshToken: "refresh123",
+		Secret:       "secret123",
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
-		store:        store,
+		Expires:      time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC),
+		NeedsReauth:  true,
+		Settings: Settings{
+			Filters:          []Filter{{Field: FilterLibrary, Value: "Kids"}},
+			MovieThreshold:   85,
+			EpisodeThreshold: 95,
+			PlexURL:          "http://plex:32400",
+			PlexToken:        "plex123",
+			WatchedSync:      true,
+			WatchlistCleanup: true,
+			Mode:             ModeCheckin,
+		},
+		store: store,
 	}
 
 	originalUser.save()
@@ -79,3 +130,22 @@ func TestPostgresqlSavingUser(t *testing.T) {
 
 	assert.EqualValues(t, string(expected), string(actual))
 }
+
+func TestPostgresqlDeleteUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM users WHERE id=").WithArgs("id123").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM scrobble_queue WHERE").WithArgs("id123").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+	mock.ExpectQuery("SELECT").WithArgs("id123").WillReturnError(sql.ErrNoRows)
+
+	store := NewPostgresqlStore(db)
+	assert.True(t, store.DeleteUser("id123", "halkeye"))
+	assert.Nil(t, store.GetUser("id123"))
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -17,6 +17,7 @@ const (
 	accessTokenTimeout = 75 * 24 * time.Hour
 	scrobbleFormat     = "goplaxt:scrobble:%s:%s"
 	scrobbleTimeout    = 3 * time.Hour
+	queueKey           = "goplaxt:queue"
 )
 
 // RedisStore is a storage engine that writes to redis
@@ -76,7 +77,19 @@ func (s RedisStore) WriteUser(user User) {
 	data["username"] = user.Username
 	data["access"] = user.AccessToken
 	data["refresh"] = user.RefreshToken
-	data["updated"] = user.Updated.Format("01-02-2006")
+	data["secret"] = user.Secret
+	data["filters"] = encodeFilters(user.Filters)
+	data["movie_threshold"] = user.MovieThreshold
+	data["episode_threshold"] = user.EpisodeThreshold
+	data["plex_url"] = user.PlexURL
+	data["plex_token"] = user.PlexToken
+	data["watched_sync"] = user.WatchedSync
+	data["collection_sync"] = user.CollectionSync
+	data["watchlist_cleanup"] = user.WatchlistCleanup
+	data["mode"] = user.Mode
+	data["updated"] = formatTime(user.Updated)
+	data["expires"] = formatTime(user.Expires)
+	data["needs_reauth"] = user.NeedsReauth
 	pipe.HMSet(userPrefix+user.ID, data)
 	pipe.Expire(userPrefix+user.ID, accessTokenTimeout)
 	// a username should always be occupied by the first id binded to it unless it's expired
@@ -98,8 +111,8 @@ func (s RedisStore) GetUser(id string) *User {
 	if err != nil {
 		return nil
 	}
-	updated, err := time.Parse("01-02-2006", data["updated"])
-	if err != nil {
+	updated := parseTime(data["updated"])
+	if updated.IsZero() {
 		return nil
 	}
 	user := User{
@@ -107,8 +120,22 @@ func (s RedisStore) GetUser(id string) *User {
 		Username:     strings.ToLower(data["username"]),
 		AccessToken:  data["access"],
 		RefreshToken: data["refresh"],
+		Secret:       data["secret"],
 		Updated:      updated,
-		store:        s,
+		Expires:      parseTime(data["expires"]),
+		NeedsReauth:  parseBool(data["needs_reauth"]),
+		Settings: Settings{
+			Filters:          decodeFilters(data["filters"]),
+			MovieThreshold:   atoi(data["movie_threshold"]),
+			EpisodeThreshold: atoi(data["episode_threshold"]),
+			PlexURL:          data["plex_url"],
+			PlexToken:        data["plex_token"],
+			WatchedSync:      parseBool(data["watched_sync"]),
+			CollectionSync:   parseBool(data["collection_sync"]),
+			WatchlistCleanup: parseBool(data["watchlist_cleanup"]),
+			Mode:             data["mode"],
+		},
+		store: s,
 	}
 
 	return &user
@@ -123,11 +150,38 @@ func (s RedisStore) GetUserByName(username string) *User {
 	return s.GetUser(id)
 }
 
-// DeleteUser will delete a user from redis
+// ListUsers will load every user from redis
+func (s RedisStore) ListUsers() []User {
+	var users []User
+	iter := s.client.Scan(0, userPrefix+"*", 100).Iterator()
+	for iter.Next() {
+		if user := s.GetUser(strings.TrimPrefix(iter.Val(), userPrefix)); user != nil {
+			users = append(users, *user)
+		}
+	}
+	return users
+}
+
+// DeleteUser will delete a user from redis, along with their cached and queued scrobbles
 func (s RedisStore) DeleteUser(id, username string) bool {
 	pipe := s.client.Pipeline()
 	pipe.Del(userPrefix + id)
-	pipe.Del(userMapPrefix + username)
+	if currentUser := s.GetUserByName(username); currentUser == nil || currentUser.ID == id {
+		pipe.Del(userMapPrefix + username)
+	}
+	iter := s.client.Scan(0, fmt.Sprintf(scrobbleFormat, "*", "*"), 100).Iterator()
+	for iter.Next() {
+		var item common.CacheItem
+		cache, err := s.client.Get(iter.Val()).Bytes()
+		if err == nil && json.Unmarshal(cache, &item) == nil && item.UserID == id {
+			pipe.Del(iter.Val())
+		}
+	}
+	for _, item := range s.GetScrobbleQueue() {
+		if item.Item.UserID == id {
+			pipe.HDel(queueKey, item.ID)
+		}
+	}
 	_, err := pipe.Exec()
 	return err == nil
 }
@@ -150,3 +204,33 @@ func (s RedisStore) WriteScrobbleBody(item common.CacheItem) {
 	b, _ := json.Marshal(item)
 	s.client.Set(fmt.Sprintf(scrobbleFormat, item.PlayerUuid, item.RatingKey), b, scrobbleTimeout)
 }
+
+// EnqueueScrobble will write a failed scrobble to redis
+func (s RedisStore) EnqueueScrobble(item common.QueueItem) {
+	b, _ := json.Marshal(item)
+	err := s.client.HSet(queueKey, item.ID, b).Err()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// GetScrobbleQueue will load all the failed scrobbles from redis
+func (s RedisStore) GetScrobbleQueue() []common.QueueItem {
+	data, err := s.client.HGetAll(queueKey).Result()
+	if err != nil {
+		return nil
+	}
+	var items []common.QueueItem
+	for _, value := range data {
+		var item common.QueueItem
+		if json.Unmarshal([]byte(value), &item) == nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// DequeueScrobble will remove a failed scrobble from redis
+func (s RedisStore) DequeueScrobble(id string) {
+	s.client.HDel(queueKey, id)
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/alicebob/miniredis/v2"
 	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/common"
 )
 
 func TestLoadingUser(t *testing.T) {
@@ -22,14 +23,39 @@ func TestLoadingUser(t *testing.T) {
 	s.HSet("goplaxt:user:id123", "username", "halkeye")
 	s.HSet("goplaxt:user:id123", "access", "access123")
 	s.HSet("goplaxt:user:id123", "refresh", "refresh123")
+	s.HSet("goplaxt:user:id123", "secret", "secret123")
+	s.HSet("goplaxt:user:id123", "filters", `[{"field":"library","value":"Kids"}]`)
+	s.HSet("goplaxt:user:id123", "movie_threshold", "85")
+	s.HSet("goplaxt:user:id123", "episode_threshold", "95")
+	s.HSet("goplaxt:user:id123", "plex_url", "http://plex:32400")
+	s.HSet("goplaxt:user:id123", "plex_token", "plex123")
+	s.HSet("goplaxt:user:id123", "watched_sync", "1")
+	s.HSet("goplaxt:user:id123", "collection_sync", "0")
+	s.HSet("goplaxt:user:id123", "watchlist_cleanup", "1")
+	s.HSet("goplaxt:user:id123", "mode", "checkin")
 	s.HSet("goplaxt:user:id123", "updated", "02-25-2019")
+	s.HSet("goplaxt:user:id123", "expires", "2019-02-26T00:00:00Z")
+	s.HSet("goplaxt:user:id123", "needs_reauth", "1")
 
 	expected, err := json.Marshal(&User{
 		ID:           "id123",
 		Username:     "halkeye",
 		AccessToken:  "access123",
 		RefreshToken: "refresh123",
+		Secret:       "secret123",
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+		Expires:      time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC),
+		NeedsReauth:  true,
+		Settings: Settings{
+			Filters:          []Filter{{Field: FilterLibrary, Value: "Kids"}},
+			MovieThreshold:   85,
+			EpisodeThreshold: 95,
+			PlexURL:          "http://plex:32400",
+			PlexToken:        "plex123",
+			WatchedSync:      true,
+			WatchlistCleanup: true,
+			Mode:             ModeCheckin,
+		},
 	})
 	actual, err := json.Marshal(store.GetUser("id123"))
 
@@ -49,8 +75,21 @@ func TestSavingUser(t *testing.T) {
 		Username:     "halkeye",
 		AccessToken:  "access123",
 		RefreshToken: "refresh123",
+		Secret:       "secret123",
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
-		store:        store,
+		Expires:      time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC),
+		NeedsReauth:  true,
+		Settings: Settings{
+			Filters:          []Filter{{Field: FilterLibrary, Value: "Kids"}},
+			MovieThreshold:   85,
+			EpisodeThreshold: 95,
+			PlexURL:          "http://plex:32400",
+			PlexToken:        "plex123",
+			WatchedSync:      true,
+			WatchlistCleanup: true,
+			Mode:             ModeCheckin,
+		},
+		store: store,
 	}
 
 	originalUser.save()
@@ -58,7 +97,17 @@ func TestSavingUser(t *testing.T) {
 	assert.Equal(t, s.HGet("goplaxt:user:id123", "username"), "halkeye")
 	assert.Equal(t, s.HGet("goplaxt:user:id123", "access"), "access123")
 	assert.Equal(t, s.HGet("goplaxt:user:id123", "refresh"), "refresh123")
-	assert.Equal(t, s.HGet("goplaxt:user:id123", "updated"), "02-25-2019")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "secret"), "secret123")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "filters"), `[{"field":"library","value":"Kids"}]`)
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "movie_threshold"), "85")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "episode_threshold"), "95")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "watched_sync"), "1")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "collection_sync"), "0")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "watchlist_cleanup"), "1")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "mode"), "checkin")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "updated"), "2019-02-25T00:00:00Z")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "expires"), "2019-02-26T00:00:00Z")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "needs_reauth"), "1")
 
 	expected, err := json.Marshal(originalUser)
 	actual, err := json.Marshal(store.GetUser("id123"))
@@ -76,3 +125,82 @@ func TestPing(t *testing.T) {
 	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
 	assert.Equal(t, store.Ping(context.TODO()), nil)
 }
+
+func TestScrobbleQueue(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	item := common.QueueItem{
+		ID:        "id123:player:42:stop",
+		Action:    "stop",
+		Attempts:  1,
+		LastError: "status code: 502",
+		Item: common.CacheItem{
+			UserID:     "id123",
+			PlayerUuid: "player",
+			RatingKey:  "42",
+		},
+	}
+	store.EnqueueScrobble(item)
+
+	queue := store.GetScrobbleQueue()
+	assert.Len(t, queue, 1)
+	assert.Equal(t, item.ID, queue[0].ID)
+	assert.Equal(t, item.Item, queue[0].Item)
+
+	store.DequeueScrobble(item.ID)
+	assert.Empty(t, store.GetScrobbleQueue())
+}
+
+func TestListUsers(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	s.HSet("goplaxt:user:id123", "username", "halkeye")
+	s.HSet("goplaxt:user:id123", "updated", "02-25-2019")
+	s.HSet("goplaxt:user:id123", "expires", "2019-02-26T00:00:00Z")
+	s.HSet("goplaxt:user:id123", "needs_reauth", "1")
+	s.HSet("goplaxt:user:id456", "username", "xanderstrike")
+	s.HSet("goplaxt:user:id456", "updated", "02-25-2019")
+
+	var usernames []string
+	for _, user := range store.ListUsers() {
+		usernames = append(usernames, user.Username)
+	}
+	assert.ElementsMatch(t, []string{"halkeye", "xanderstrike"}, usernames)
+}
+
+func TestDeleteUser(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	s.HSet("goplaxt:user:id123", "username", "halkeye")
+	s.HSet("goplaxt:user:id123", "updated", "02-25-2019")
+	s.Set("goplaxt:usermap:halkeye", "id123")
+	store.WriteScrobbleBody(common.CacheItem{UserID: "id123", PlayerUuid: "player", RatingKey: "42"})
+	store.WriteScrobbleBody(common.CacheItem{UserID: "id456", PlayerUuid: "player", RatingKey: "43"})
+	store.EnqueueScrobble(common.QueueItem{ID: "id123:player:42:stop", Item: common.CacheItem{UserID: "id123"}})
+	store.EnqueueScrobble(common.QueueItem{ID: "id456:player:43:stop", Item: common.CacheItem{UserID: "id456"}})
+
+	assert.True(t, store.DeleteUser("id123", "halkeye"))
+
+	assert.Nil(t, store.GetUser("id123"))
+	assert.Nil(t, store.GetUserByName("halkeye"))
+	assert.Empty(t, store.GetScrobbleBody("player", "42").UserID)
+	assert.Equal(t, "id456", store.GetScrobbleBody("player", "43").UserID)
+	queue := store.GetScrobbleQueue()
+	assert.Len(t, queue, 1)
+	assert.Equal(t, "id456:player:43:stop", queue[0].ID)
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"crypto/subtle"
 	"fmt"
 	"os"
 	"time"
@@ -16,8 +17,42 @@ type User struct {
 	Username     string
 	AccessToken  string
 	RefreshToken string
+	Secret       string
 	Updated      time.Time
-	store        store
+	// Expires is when the access token expires, zero for the users created before it was stored
+	Expires time.Time
+	// NeedsReauth is set when Trakt revoked the grant, the user has to authorize again
+	NeedsReauth bool
+	Settings
+	store store
+}
+
+// Ways of reporting plays to Trakt
+const (
+	// ModeScrobble reports the progress of plays through the scrobble API
+	ModeScrobble = "scrobble"
+	// ModeCheckin checks in when a play starts, which can be shared to social networks
+	ModeCheckin = "checkin"
+)
+
+// Settings are the preferences a user edits from the settings page
+type Settings struct {
+	Filters []Filter
+	// MovieThreshold and EpisodeThreshold are the progress percentages after
+	// which a play is watched, 0 means the instance default
+	MovieThreshold   int
+	EpisodeThreshold int
+	// PlexURL and PlexToken give access to the user's Plex Media Server
+	PlexURL   string
+	PlexToken string
+	// WatchedSync marks the items watched on Trakt as played in Plex
+	WatchedSync bool
+	// CollectionSync mirrors the Plex libraries to the Trakt collection
+	CollectionSync bool
+	// WatchlistCleanup removes the watched movies and finished shows from the Trakt watchlist
+	WatchlistCleanup bool
+	// Mode is ModeScrobble or ModeCheckin, empty means ModeScrobble
+	Mode string
 }
 
 func uuid() string {
@@ -30,26 +65,45 @@ func uuid() string {
 	return uuid
 }
 
-// NewUser creates a new user object
-func NewUser(username, accessToken, refreshToken string, store store) User {
+// NewUser creates a new user object, expires is when the access token expires
+func NewUser(username, accessToken, refreshToken string, expires time.Time, store store) User {
 	id := uuid()
 	user := User{
 		ID:           id,
 		Username:     username,
 		AccessToken:  accessToken,
 		RefreshToken: refreshToken,
+		Secret:       uuid(),
 		Updated:      time.Now(),
+		Expires:      expires,
 		store:        store,
 	}
 	user.save()
 	return user
 }
 
+// RequireReauth records that the user has to authorize again, keeping their ID and secret
+func (user *User) RequireReauth() {
+	user.NeedsReauth = true
+	user.save()
+}
+
+// NeedsRefresh tells whether the access token expires within margin
+func (user User) NeedsRefresh(margin time.Duration) bool {
+	if user.Expires.IsZero() {
+		// tokens used to be refreshed after 23 hours
+		return time.Since(user.Updated) > 23*time.Hour-margin
+	}
+	return time.Until(user.Expires) < margin
+}
+
 // UpdateUser updates an existing user object
-func (user *User) UpdateUser(accessToken, refreshToken string) {
+func (user *User) UpdateUser(accessToken, refreshToken string, expires time.Time) {
 	user.AccessToken = accessToken
 	user.RefreshToken = refreshToken
 	user.Updated = time.Now()
+	user.Expires = expires
+	user.NeedsReauth = false
 
 	user.save()
 }
@@ -57,3 +111,32 @@ func (user *User) UpdateUser(accessToken, refreshToken string) {
 func (user User) save() {
 	user.store.WriteUser(user)
 }
+
+// VerifySecret checks the secret of a webhook link, users created before
+// secrets existed have none and accept any
+func (user User) VerifySecret(secret string) bool {
+	if user.Secret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(user.Secret), []byte(secret)) == 1
+}
+
+// RotateSecret replaces the secret, invalidating the previous webhook links
+func (user *User) RotateSecret() {
+	user.Secret = uuid()
+	user.save()
+}
+
+// UpdateSettings saves the preferences edited from the settings page
+func (user *User) UpdateSettings(settings Settings) {
+	user.Settings = settings
+	user.save()
+}
+
+// RedactID hides most of an ID so that it can be logged
+func RedactID(id string) string {
+	if len(id) <= 4 {
+		return "****"
+	}
+	return id[:4] + "****"
+}
@@ -0,0 +1,39 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifySecret(t *testing.T) {
+	user := User{ID: "id123", Secret: "secret123"}
+	assert.True(t, user.VerifySecret("secret123"))
+	assert.False(t, user.VerifySecret("secret12"))
+	assert.False(t, user.VerifySecret(""))
+
+	legacy := User{ID: "id123"}
+	assert.True(t, legacy.VerifySecret(""))
+}
+
+func TestRedactID(t *testing.T) {
+	assert.Equal(t, "abcd****", RedactID("abcdef0123456789"))
+	assert.Equal(t, "****", RedactID("abc"))
+}
+
+func TestNeedsRefresh(t *testing.T) {
+	assert.False(t, User{Expires: time.Now().Add(3 * time.Hour)}.NeedsRefresh(2*time.Hour))
+	assert.True(t, User{Expires: time.Now().Add(time.Hour)}.NeedsRefresh(2*time.Hour))
+	assert.True(t, User{Expires: time.Now().Add(-time.Hour)}.NeedsRefresh(0))
+
+	assert.False(t, User{Updated: time.Now()}.NeedsRefresh(2*time.Hour))
+	assert.True(t, User{Updated: time.Now().Add(-22 * time.Hour)}.NeedsRefresh(2*time.Hour))
+}
+
+func TestParseTime(t *testing.T) {
+	updated := time.Date(2019, 02, 25, 13, 14, 15, 16, time.UTC)
+	assert.Equal(t, updated, parseTime(formatTime(updated)))
+	assert.Equal(t, time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC), parseTime("02-25-2019"))
+	assert.True(t, parseTime("").IsZero())
+}
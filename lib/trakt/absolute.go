@@ -0,0 +1,156 @@
+package trakt
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// absoluteTTL is how long the episode numbering of a show is cached
+const absoluteTTL = 24 * time.Hour
+
+// seasonEpisodes is an item of /shows/{id}/seasons?extended=full,episodes
+type seasonEpisodes struct {
+	Number   int `json:"number"`
+	Episodes []struct {
+		Season    int  `json:"season"`
+		Number    int  `json:"number"`
+		NumberAbs *int `json:"number_abs"`
+	} `json:"episodes"`
+}
+
+// showSearchResult is an item of /search/{id_type}/{id}?type=show or ?type=episode
+type showSearchResult struct {
+	Show    common.Show    `json:"show"`
+	Episode common.Episode `json:"episode"`
+}
+
+// absoluteNumbering maps the absolute numbers of a show to their season and number
+type absoluteNumbering struct {
+	episodes map[int][2]int
+	fetched  time.Time
+}
+
+// absoluteCache keeps the numbering of the shows recently played, its zero value is ready to use
+type absoluteCache struct {
+	mu    sync.Mutex
+	shows map[string]absoluteNumbering
+}
+
+// resolveAbsolute replaces the absolute number of an episode by its season and
+// number on Trakt, it returns false when the episode cannot be found
+func (t *Trakt) resolveAbsolute(body *common.ScrobbleBody) bool {
+	if body.Episode == nil || body.Episode.NumberAbs == nil {
+		return true
+	}
+	if body.Show == nil {
+		return false
+	}
+	abs := *body.Episode.NumberAbs
+	episodes, err := t.absoluteEpisodes(body.Show.Ids)
+	if err != nil {
+		log.Printf("Cannot get the episodes of show %v: %s", idKeys(body.Show.Ids), err)
+		return false
+	}
+	episode, ok := episodes[abs]
+	if !ok {
+		log.Printf("Show %v has no episode numbered %d", idKeys(body.Show.Ids), abs)
+		return false
+	}
+	season, number := episode[0], episode[1]
+	body.Episode = &common.Episode{Season: &season, Number: &number}
+	return true
+}
+
+// absoluteEpisodes numbers the episodes of a show with the absolute numbers
+// of Trakt, or by counting them across the regular seasons when it has none
+func (t *Trakt) absoluteEpisodes(ids common.Ids) (map[int][2]int, error) {
+	key := fmt.Sprint(idKeys(ids))
+	if ids.Trakt != nil {
+		key = fmt.Sprintf("trakt:%d", *ids.Trakt)
+	}
+	t.absolute.mu.Lock()
+	cached, ok := t.absolute.shows[key]
+	t.absolute.mu.Unlock()
+	if ok && time.Since(cached.fetched) < absoluteTTL {
+		return cached.episodes, nil
+	}
+
+	id, err := t.traktShowID(ids)
+	if err != nil {
+		return nil, err
+	}
+	var seasons []seasonEpisodes
+	if err := t.getJSON(fmt.Sprintf("/shows/%s/seasons?extended=full,episodes", id), "", &seasons); err != nil {
+		return nil, err
+	}
+	numbered := make(map[int][2]int)
+	counted := make(map[int][2]int)
+	for _, season := range seasons {
+		if season.Number == 0 {
+			continue
+		}
+		for _, episode := range season.Episodes {
+			counted[len(counted)+1] = [2]int{episode.Season, episode.Number}
+			if episode.NumberAbs != nil {
+				numbered[*episode.NumberAbs] = [2]int{episode.Season, episode.Number}
+			}
+		}
+	}
+	episodes := counted
+	if len(numbered) > 0 {
+		episodes = numbered
+	}
+
+	t.absolute.mu.Lock()
+	defer t.absolute.mu.Unlock()
+	if t.absolute.shows == nil {
+		t.absolute.shows = make(map[string]absoluteNumbering)
+	}
+	t.absolute.shows[key] = absoluteNumbering{episodes: episodes, fetched: time.Now()}
+	return episodes, nil
+}
+
+// traktShowID finds the Trakt ID of a show known by its external IDs
+func (t *Trakt) traktShowID(ids common.Ids) (string, error) {
+	switch {
+	case ids.Trakt != nil:
+		return fmt.Sprint(*ids.Trakt), nil
+	case ids.Slug != nil:
+		return *ids.Slug, nil
+	}
+	result, err := t.searchID(ids, "show")
+	if err != nil {
+		return "", err
+	}
+	if result.Show.Ids.Trakt == nil {
+		return "", fmt.Errorf("show not found")
+	}
+	return fmt.Sprint(*result.Show.Ids.Trakt), nil
+}
+
+// searchID finds the show or the episode, depending on kind, known by its external IDs
+func (t *Trakt) searchID(ids common.Ids, kind string) (showSearchResult, error) {
+	var path string
+	switch {
+	case ids.Tvdb != nil:
+		path = fmt.Sprintf("/search/tvdb/%d?type=%s", *ids.Tvdb, kind)
+	case ids.Tmdb != nil:
+		path = fmt.Sprintf("/search/tmdb/%d?type=%s", *ids.Tmdb, kind)
+	case ids.Imdb != nil:
+		path = fmt.Sprintf("/search/imdb/%s?type=%s", *ids.Imdb, kind)
+	default:
+		return showSearchResult{}, fmt.Errorf("no ids")
+	}
+	var results []showSearchResult
+	if err := t.getJSON(path, "", &results); err != nil {
+		return showSearchResult{}, err
+	}
+	if len(results) == 0 {
+		return showSearchResult{}, fmt.Errorf("%s not found", kind)
+	}
+	return results[0], nil
+}
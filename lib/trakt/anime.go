@@ -0,0 +1,92 @@
+package trakt
+
+import (
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/xanderstrike/goplaxt/lib/animelist"
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// anidbID reads the series of a HAMA guid, e.g. com.plexapp.agents.hama://anidb-23/1/5?lang=en
+func anidbID(guid string) (int, bool) {
+	u, err := url.Parse(guid)
+	if err != nil || !strings.HasSuffix(u.Scheme, "hama") || !strings.HasPrefix(u.Host, "anidb-") {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(u.Host, "anidb-"))
+	return id, err == nil
+}
+
+// findAnime looks the series of a HAMA guid up in the anime list
+func (t *Trakt) findAnime(guid string) (animelist.Anime, bool) {
+	id, ok := anidbID(guid)
+	if !ok {
+		return animelist.Anime{}, false
+	}
+	if t.AnimeList == nil {
+		log.Printf("Cannot map %s without an anime list", guid)
+		return animelist.Anime{}, false
+	}
+	anime, ok := t.AnimeList.Anime(id)
+	if !ok {
+		log.Printf("AniDB series %d is missing from the anime list", id)
+	}
+	return anime, ok
+}
+
+// findAnimeEpisode maps the AniDB episode of a HAMA guid to its TVDB show and episode
+func (t *Trakt) findAnimeEpisode(guid string) *common.ScrobbleBody {
+	anime, ok := t.findAnime(guid)
+	if !ok {
+		return nil
+	}
+	tvdb, ok := anime.Tvdb()
+	if !ok {
+		log.Printf("AniDB series %d (%s) isn't on TVDB", anime.AnidbID, anime.Name)
+		return nil
+	}
+	match := episodeRegex.FindStringSubmatch(guid)
+	if match == nil {
+		log.Printf("Unmatched guid: %s", guid)
+		return nil
+	}
+	season, _ := strconv.Atoi(match[2])
+	number, _ := strconv.Atoi(match[3])
+	mapped, ok := anime.Episode(season, number)
+	if !ok {
+		log.Printf("AniDB episode %d/%d of %s has no TVDB equivalent", season, number, anime.Name)
+		return nil
+	}
+	episode := common.Episode{}
+	if mapped.Absolute {
+		episode.NumberAbs = &mapped.Number
+	} else {
+		episode.Season = &mapped.Season
+		episode.Number = &mapped.Number
+	}
+	return &common.ScrobbleBody{
+		Show:    &common.Show{Ids: common.Ids{Tvdb: &tvdb}},
+		Episode: &episode,
+	}
+}
+
+// findAnimeMovie maps the AniDB movie of a HAMA guid to its TMDB or IMDB ID
+func (t *Trakt) findAnimeMovie(guid string) *common.Movie {
+	anime, ok := t.findAnime(guid)
+	if !ok {
+		return nil
+	}
+	movie := common.Movie{}
+	if tmdb, ok := anime.Tmdb(); ok {
+		movie.Ids.Tmdb = &tmdb
+	} else if imdb, ok := anime.Imdb(); ok {
+		movie.Ids.Imdb = &imdb
+	} else {
+		log.Printf("AniDB movie %d (%s) has neither a TMDB nor an IMDB ID", anime.AnidbID, anime.Name)
+		return nil
+	}
+	return &movie
+}
@@ -0,0 +1,82 @@
+package trakt
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/animelist"
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func TestHandleAnime(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123"}
+
+	wh := newMovieWebhook("media.play", 10)
+	wh.Metadata.LibrarySectionType = "show"
+	wh.Metadata.ExternalGuid = nil
+	wh.Metadata.Guid = "com.plexapp.agents.hama://anidb-6662/1/14?lang=en"
+	trakt.Handle(wh, user)
+	assert.Empty(t, server.Calls())
+
+	path := filepath.Join(t.TempDir(), "anime-list.xml")
+	_ = os.WriteFile(path, []byte(`<anime-list>
+		<anime anidbid="6662" tvdbid="81797" defaulttvdbseason="2">
+			<mapping-list><mapping anidbseason="1" tvdbseason="3" start="14" end="26" offset="-13"/></mapping-list>
+		</anime>
+		<anime anidbid="4597" tvdbid="79824" defaulttvdbseason="a"/>
+		<anime anidbid="8" tvdbid="movie" tmdbid="149"/>
+	</anime-list>`), 0644)
+	list, err := animelist.Load(path)
+	assert.Nil(t, err)
+	trakt.AnimeList = list
+	server.Respond(http.MethodGet, "/search/tvdb/79824", http.StatusOK, []map[string]interface{}{
+		{"type": "show", "show": map[string]interface{}{"ids": map[string]int{"trakt": 31, "tvdb": 79824}}},
+	})
+	server.Respond(http.MethodGet, "/shows/31/seasons", http.StatusOK, []map[string]interface{}{
+		{"number": 0, "episodes": []map[string]int{{"season": 0, "number": 1}}},
+		{"number": 5, "episodes": []map[string]int{{"season": 5, "number": 7, "number_abs": 119}, {"season": 5, "number": 8, "number_abs": 120}}},
+	})
+
+	trakt.Handle(wh, user)
+	wh.Metadata.Guid = "com.plexapp.agents.hama://anidb-4597/1/120?lang=en"
+	trakt.Handle(wh, user)
+	wh.Metadata.Guid = "com.plexapp.agents.hama://anidb-1/1/1?lang=en"
+	trakt.Handle(wh, user)
+
+	wh.Metadata.LibrarySectionType = "movie"
+	wh.Metadata.Guid = "com.plexapp.agents.hama://anidb-8?lang=en"
+	trakt.Handle(wh, user)
+
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 3)
+	assert.JSONEq(t, `{"progress":10,"show":{"ids":{"tvdb":81797}},"episode":{"season":3,"number":1}}`, string(starts[0].Body))
+	assert.JSONEq(t, `{"progress":10,"show":{"ids":{"tvdb":79824}},"episode":{"season":5,"number":8}}`, string(starts[1].Body))
+	assert.JSONEq(t, `{"progress":10,"movie":{"ids":{"tmdb":149}}}`, string(starts[2].Body))
+}
+
+func TestAbsoluteEpisodes(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	server.Respond(http.MethodGet, "/shows/31/seasons", http.StatusOK, []map[string]interface{}{
+		{"number": 0, "episodes": []map[string]int{{"season": 0, "number": 1}}},
+		{"number": 1, "episodes": []map[string]int{{"season": 1, "number": 1}, {"season": 1, "number": 2}}},
+		{"number": 2, "episodes": []map[string]int{{"season": 2, "number": 1}}},
+	})
+
+	trakt31 := 31
+	episodes, err := trakt.absoluteEpisodes(common.Ids{Trakt: &trakt31})
+	assert.Nil(t, err)
+	assert.Equal(t, map[int][2]int{1: {1, 1}, 2: {1, 2}, 3: {2, 1}}, episodes)
+
+	_, _ = trakt.absoluteEpisodes(common.Ids{Trakt: &trakt31})
+	assert.Len(t, server.CallsTo(http.MethodGet, "/shows/31/seasons"), 1)
+}
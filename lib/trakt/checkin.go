@@ -0,0 +1,91 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// checkinBody is the item checked in, Trakt rejects the scrobble progress
+type checkinBody struct {
+	Movie   *common.Movie   `json:"movie,omitempty"`
+	Show    *common.Show    `json:"show,omitempty"`
+	Episode *common.Episode `json:"episode,omitempty"`
+}
+
+// sendCheckin reports a play through the check-in API: a start checks in, a
+// pause keeps the check-in running and a stop cancels it, adding the item to
+// the history when it was watched. A media.stop below the threshold only
+// cancels it, otherwise Trakt would mark the item watched once it expires.
+func (t *Trakt) sendCheckin(action string, item *common.CacheItem, accessToken string) error {
+	switch action {
+	case actionStart:
+		err := t.checkin(item, accessToken)
+		if httpErr, ok := err.(HttpError); ok && httpErr.Code == http.StatusConflict {
+			log.Print("Already checked in, cancelling the previous check-in")
+			if err := t.cancelCheckin(accessToken); err != nil {
+				return err
+			}
+			err = t.checkin(item, accessToken)
+		}
+		return err
+	case actionPause:
+		if item.Trigger != "media.stop" {
+			return nil
+		}
+		return t.cancelCheckin(accessToken)
+	case actionStop:
+		if err := t.cancelCheckin(accessToken); err != nil {
+			return err
+		}
+		var sync syncBody
+		if !sync.add(item.Body, syncFields{WatchedAt: time.Now().UTC().Format(time.RFC3339)}) {
+			log.Printf("Cannot add %s to the history without its season and number", item.Body)
+			return nil
+		}
+		return t.syncRequest("/sync/history", accessToken, sync)
+	}
+	return fmt.Errorf("unknown action %s", action)
+}
+
+// checkin posts the item to the check-in API and updates it with the response
+func (t *Trakt) checkin(item *common.CacheItem, accessToken string) error {
+	body, _ := json.Marshal(checkinBody{
+		Movie:   item.Body.Movie,
+		Show:    item.Body.Show,
+		Episode: item.Body.Episode,
+	})
+	resp, err := t.request(http.MethodPost, "/checkin", accessToken, body)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		return NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	_ = json.Unmarshal(respBody, &item.Body)
+	return nil
+}
+
+// cancelCheckin removes the running check-in of the user, if any
+func (t *Trakt) cancelCheckin(accessToken string) error {
+	resp, err := t.request(http.MethodDelete, "/checkin", accessToken, nil)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+	}
+	return nil
+}
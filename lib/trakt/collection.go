@@ -0,0 +1,249 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/plex"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// Plex's videoResolution and audioCodec values to Trakt's collection metadata
+var (
+	traktResolutions = map[string]string{
+		"4k":   "uhd_4k",
+		"1080": "hd_1080p",
+		"720":  "hd_720p",
+		"576":  "sd_576p",
+		"480":  "sd_480p",
+		"sd":   "sd_480p",
+	}
+	traktAudioCodecs = map[string]string{
+		"aac":    "aac",
+		"ac3":    "dolby_digital",
+		"eac3":   "dolby_digital_plus",
+		"truehd": "dolby_truehd",
+		"dca":    "dts",
+		"dts":    "dts",
+		"dca-ma": "dts_ma",
+		"flac":   "flac",
+		"mp2":    "mp2",
+		"mp3":    "mp3",
+		"pcm":    "lpcm",
+		"opus":   "ogg_opus",
+		"vorbis": "ogg",
+		"wmav2":  "wma",
+		"wmapro": "wma",
+	}
+)
+
+// collect adds the movie or episode of a library.new event to the Trakt collection
+func (t *Trakt) collect(wh hooks.Webhook, user store.User) {
+	pr := wh.PlexResponse
+	if !user.CollectionSync {
+		log.Printf("Event %s ignored, collection sync is disabled", pr.Event)
+		return
+	}
+	if f := matchFilter(pr, user.Filters); f != nil {
+		log.Printf("Event %s ignored by rule %s", pr.Event, f)
+		return
+	}
+	var body *common.ScrobbleBody
+	switch pr.Metadata.Type {
+	case "movie":
+		body = t.handleMovie(pr, user)
+	case "episode":
+		body = t.handleShow(wh, user)
+	default:
+		log.Printf("Collection of %s ignored", pr.Metadata.Type)
+		return
+	}
+	if body == nil {
+		log.Printf("Cannot find %s to collect", pr.Metadata.Type)
+		return
+	}
+
+	fields := mediaFields(wh.Extra.Metadata.Media)
+	if pr.Metadata.AddedAt > 0 {
+		fields.CollectedAt = time.Unix(int64(pr.Metadata.AddedAt), 0).UTC().Format(time.RFC3339)
+	}
+	var sync syncBody
+	if !sync.add(*body, syncFields{collectionFields: fields}) {
+		log.Printf("Cannot collect %s without its season and number", pr.Metadata.Type)
+		return
+	}
+	b, _ := json.Marshal(sync)
+	if err := t.syncRequest("/sync/collection", user.AccessToken, sync); err != nil {
+		log.Printf("/sync/collection failed (%s): %s", err, string(b))
+		return
+	}
+	log.Printf("Collected: %s", string(b))
+}
+
+// mediaFields describes the first media of a library item in Trakt's terms
+func mediaFields(media []hooks.Media) collectionFields {
+	fields := collectionFields{MediaType: "digital"}
+	if len(media) == 0 {
+		return fields
+	}
+	m := media[0]
+	fields.Resolution = traktResolutions[m.VideoResolution]
+	fields.Audio = traktAudioCodecs[m.AudioCodec]
+	switch {
+	case m.AudioChannels <= 0:
+	case m.AudioChannels <= 2:
+		fields.AudioChannels = fmt.Sprintf("%d.0", m.AudioChannels)
+	default:
+		fields.AudioChannels = fmt.Sprintf("%d.1", m.AudioChannels-1)
+	}
+	for _, part := range m.Part {
+		for _, stream := range part.Stream {
+			if stream.StreamType != 1 {
+				continue
+			}
+			switch {
+			case stream.DOVIPresent:
+				fields.Hdr = "dolby_vision"
+			case stream.ColorTrc == "smpte2084":
+				fields.Hdr = "hdr10"
+			case stream.ColorTrc == "arib-std-b67":
+				fields.Hdr = "hlg"
+			}
+			return fields
+		}
+	}
+	return fields
+}
+
+// RunCollectionSync removes the items missing from Plex from the Trakt collection every interval, it never returns
+func (t *Trakt) RunCollectionSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		common.Safely("Collection sync", t.syncCollectionUsers)
+	}
+}
+
+func (t *Trakt) syncCollectionUsers() {
+	for _, user := range t.storage.ListUsers() {
+		if !user.CollectionSync || user.PlexURL == "" || user.PlexToken == "" {
+			continue
+		}
+		if err := t.SyncCollection(user, plex.New(user.PlexURL, user.PlexToken)); err != nil {
+			log.Printf("Collection sync of %s failed: %s", user.Username, err)
+		}
+	}
+}
+
+// SyncCollection removes the movies and episodes which are no longer in the
+// Plex libraries from the user's Trakt collection. Nothing is removed when
+// an item of the libraries cannot be identified.
+func (t *Trakt) SyncCollection(user store.User, client *plex.Client) error {
+	sections, err := client.Sections()
+	if err != nil {
+		return err
+	}
+	libraryMovies := make(map[string]bool)
+	libraryShows := make(map[string]map[string]bool)
+	libraries := 0
+	var unidentified []string
+	for _, section := range sections {
+		if section.Type != "movie" && section.Type != "show" {
+			continue
+		}
+		libraries++
+		items, err := client.Items(section.Key)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			ids, isValid := parseGuids(item.ExternalGuid)
+			if !isValid {
+				unidentified = append(unidentified, item.Title)
+				continue
+			}
+			if section.Type == "movie" {
+				for _, key := range idKeys(ids) {
+					libraryMovies[key] = true
+				}
+				continue
+			}
+			episodes, err := client.Episodes(item.RatingKey)
+			if err != nil {
+				return err
+			}
+			collected := make(map[string]bool)
+			for _, episode := range episodes {
+				collected[episodeKey(episode.ParentIndex, episode.Index)] = true
+			}
+			for _, key := range idKeys(ids) {
+				libraryShows[key] = collected
+			}
+		}
+	}
+	if libraries == 0 {
+		// an empty answer more likely means a lack of access than an empty server
+		return fmt.Errorf("no movie or show library found on %s", client.URL)
+	}
+	if len(unidentified) > 0 {
+		// their Trakt entries cannot be told apart from the stale ones
+		return fmt.Errorf("%d items without IMDB, TMDB or TVDB ids on %s, e.g. %q, the collection is left as is",
+			len(unidentified), client.URL, unidentified[0])
+	}
+
+	var movies []movieEntry
+	if err := t.getJSON("/sync/collection/movies", user.AccessToken, &movies); err != nil {
+		return err
+	}
+	var shows []showEntry
+	if err := t.getJSON("/sync/collection/shows", user.AccessToken, &shows); err != nil {
+		return err
+	}
+	remove := staleCollection(movies, shows, libraryMovies, libraryShows)
+	if remove.empty() {
+		return nil
+	}
+	b, _ := json.Marshal(remove)
+	if err := t.syncRequest("/sync/collection/remove", user.AccessToken, remove); err != nil {
+		return err
+	}
+	log.Printf("Removed from the collection of %s: %s", user.Username, string(b))
+	return nil
+}
+
+// staleCollection lists the collected items missing from the Plex libraries
+func staleCollection(movies []movieEntry, shows []showEntry, libraryMovies map[string]bool, libraryShows map[string]map[string]bool) syncBody {
+	var remove syncBody
+	for _, m := range movies {
+		if !matchIds(m.Movie.Ids, libraryMovies) {
+			remove.Movies = append(remove.Movies, syncItem{Ids: m.Movie.Ids})
+		}
+	}
+	for _, s := range shows {
+		episodes := showEpisodes(s.Show.Ids, libraryShows)
+		if episodes == nil {
+			remove.Shows = append(remove.Shows, syncItem{Ids: s.Show.Ids})
+			continue
+		}
+		item := syncItem{Ids: s.Show.Ids}
+		for _, season := range s.Seasons {
+			stale := syncSeason{Number: season.Number}
+			for _, episode := range season.Episodes {
+				if !episodes[episodeKey(season.Number, episode.Number)] {
+					stale.Episodes = append(stale.Episodes, syncEpisode{Number: episode.Number})
+				}
+			}
+			if len(stale.Episodes) > 0 {
+				item.Seasons = append(item.Seasons, stale)
+			}
+		}
+		if len(item.Seasons) > 0 {
+			remove.Shows = append(remove.Shows, item)
+		}
+	}
+	return remove
+}
@@ -0,0 +1,123 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/plex"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func TestMediaFields(t *testing.T) {
+	assert.Equal(t, collectionFields{MediaType: "digital"}, mediaFields(nil))
+
+	media := []hooks.Media{{
+		VideoResolution: "4k",
+		AudioCodec:      "truehd",
+		AudioChannels:   8,
+		Part: []hooks.Part{{Stream: []hooks.Stream{
+			{StreamType: 1, ColorTrc: "smpte2084"},
+			{StreamType: 2},
+		}}},
+	}}
+	assert.Equal(t, collectionFields{
+		MediaType:     "digital",
+		Resolution:    "uhd_4k",
+		Hdr:           "hdr10",
+		Audio:         "dolby_truehd",
+		AudioChannels: "7.1",
+	}, mediaFields(media))
+
+	media = []hooks.Media{{VideoResolution: "1080", AudioCodec: "aac", AudioChannels: 2}}
+	assert.Equal(t, collectionFields{
+		MediaType:     "digital",
+		Resolution:    "hd_1080p",
+		Audio:         "aac",
+		AudioChannels: "2.0",
+	}, mediaFields(media))
+}
+
+func TestStaleCollection(t *testing.T) {
+	var movies []movieEntry
+	_ = json.Unmarshal([]byte(`[
+		{"movie": {"ids": {"tmdb": 603}}},
+		{"movie": {"ids": {"tmdb": 604, "imdb": "tt0234215"}}}
+	]`), &movies)
+	var shows []showEntry
+	_ = json.Unmarshal([]byte(`[
+		{"show": {"ids": {"tvdb": 81189}}, "seasons": [{"number": 1, "episodes": [{"number": 1}, {"number": 2}]}]},
+		{"show": {"ids": {"tvdb": 121361}}, "seasons": [{"number": 1, "episodes": [{"number": 1}]}]}
+	]`), &shows)
+	libraryMovies := map[string]bool{"imdb:tt0234215": true}
+	libraryShows := map[string]map[string]bool{"tvdb:81189": {episodeKey(1, 1): true}}
+
+	b, _ := json.Marshal(staleCollection(movies, shows, libraryMovies, libraryShows))
+	assert.JSONEq(t, `{
+		"movies": [{"ids": {"tmdb": 603}}],
+		"shows": [
+			{"ids": {"tvdb": 81189}, "seasons": [{"number": 1, "episodes": [{"number": 2}]}]},
+			{"ids": {"tvdb": 121361}}
+		]
+	}`, string(b))
+}
+
+func TestSyncCollection(t *testing.T) {
+	movies := `{"title":"The Matrix Reloaded","Guid":[{"id":"imdb://tt0234215"}]}`
+	pms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/library/sections":
+			fmt.Fprint(w, `{"MediaContainer":{"Directory":[{"key":"1","type":"movie"},{"key":"2","type":"show"},{"key":"3","type":"artist"}]}}`)
+		case "/library/sections/1/all":
+			fmt.Fprintf(w, `{"MediaContainer":{"Metadata":[%s]}}`, movies)
+		case "/library/sections/2/all":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"10","title":"Firefly","Guid":[{"id":"tvdb://78874"}]}]}}`)
+		case "/library/metadata/10/allLeaves":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"parentIndex":1,"index":1}]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer pms.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", Username: "halkeye", AccessToken: "access123"}
+	collected := func() {
+		server.Respond(http.MethodGet, "/sync/collection/movies", http.StatusOK, json.RawMessage(`[
+			{"movie": {"ids": {"trakt": 2, "imdb": "tt0234215"}}},
+			{"movie": {"ids": {"trakt": 1, "imdb": "tt0133093"}}}
+		]`))
+		server.Respond(http.MethodGet, "/sync/collection/shows", http.StatusOK, json.RawMessage(`[
+			{"show": {"ids": {"trakt": 3, "tvdb": 78874}}, "seasons": [{"number": 1, "episodes": [{"number": 1}, {"number": 2}]}]},
+			{"show": {"ids": {"trakt": 4, "tvdb": 81189}}, "seasons": [{"number": 1, "episodes": [{"number": 1}]}]}
+		]`))
+	}
+
+	collected()
+	assert.Nil(t, trakt.SyncCollection(user, plex.New(pms.URL, "plex123")))
+	removed := server.CallsTo(http.MethodPost, "/sync/collection/remove")
+	assert.Len(t, removed, 1)
+	assert.Equal(t, "access123", removed[0].AccessToken)
+	assert.JSONEq(t, `{
+		"movies": [{"ids": {"trakt": 1, "imdb": "tt0133093"}}],
+		"shows": [
+			{"ids": {"trakt": 3, "tvdb": 78874}, "seasons": [{"number": 1, "episodes": [{"number": 2}]}]},
+			{"ids": {"trakt": 4, "tvdb": 81189}}
+		]
+	}`, string(removed[0].Body))
+
+	// a movie Plex cannot identify may be any of the collected ones
+	server.Reset()
+	collected()
+	movies += `,{"title":"Home Movie"}`
+	err := trakt.SyncCollection(user, plex.New(pms.URL, "plex123"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "Home Movie")
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/sync/collection/remove"))
+}
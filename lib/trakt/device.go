@@ -0,0 +1,106 @@
+package trakt
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// DeviceCode is a code the user enters on Trakt to authorize goplaxt without being redirected back to it
+type DeviceCode struct {
+	DeviceCode      string `json:"device_code"`
+	UserCode        string `json:"user_code"`
+	VerificationURL string `json:"verification_url"`
+	// ExpiresIn and Interval are in seconds
+	ExpiresIn int `json:"expires_in"`
+	Interval  int `json:"interval"`
+}
+
+var (
+	errAuthorizationPending = errors.New("authorization pending")
+	errSlowDown             = errors.New("polling too fast")
+)
+
+// deviceTokenErrors are the answers of /oauth/device/token ending the polling
+var deviceTokenErrors = map[int]string{
+	http.StatusNotFound: "invalid device code",
+	http.StatusConflict: "device code already used",
+	http.StatusGone:     "device code expired",
+	418:                 "authorization denied",
+}
+
+// RequestDeviceCode starts the device authorization flow
+func (t *Trakt) RequestDeviceCode() (DeviceCode, error) {
+	var code DeviceCode
+	body, _ := json.Marshal(map[string]string{"client_id": t.ClientId})
+	resp, err := t.request(http.MethodPost, "/oauth/device/code", "", body)
+	if err != nil {
+		return code, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return code, NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+	}
+	err = json.NewDecoder(resp.Body).Decode(&code)
+	return code, err
+}
+
+// PollDeviceToken waits for the user to enter the code on Trakt and returns
+// the tokens, in the same shape as AuthRequest
+func (t *Trakt) PollDeviceToken(code DeviceCode) (map[string]interface{}, error) {
+	interval := time.Duration(code.Interval) * time.Second
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	expires := time.Now().Add(time.Duration(code.ExpiresIn) * time.Second)
+	for time.Now().Before(expires) {
+		time.Sleep(interval)
+		result, err := t.deviceToken(code.DeviceCode)
+		switch err {
+		case nil:
+			return result, nil
+		case errAuthorizationPending:
+		case errSlowDown:
+			interval += time.Second
+		default:
+			return nil, err
+		}
+	}
+	return nil, errors.New(deviceTokenErrors[http.StatusGone])
+}
+
+func (t *Trakt) deviceToken(deviceCode string) (map[string]interface{}, error) {
+	body, _ := json.Marshal(map[string]string{
+		"code":          deviceCode,
+		"client_id":     t.ClientId,
+		"client_secret": t.clientSecret,
+	})
+	resp, err := t.request(http.MethodPost, "/oauth/device/token", "", body)
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var result map[string]interface{}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		return result, err
+	case http.StatusBadRequest:
+		return nil, errAuthorizationPending
+	case http.StatusTooManyRequests:
+		return nil, errSlowDown
+	}
+	if message, ok := deviceTokenErrors[resp.StatusCode]; ok {
+		return nil, errors.New(message)
+	}
+	return nil, NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+}
@@ -0,0 +1,27 @@
+package trakt
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func TestPollDeviceToken(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+
+	code, err := trakt.RequestDeviceCode()
+	assert.Nil(t, err)
+	assert.Equal(t, "ABCD1234", code.UserCode)
+
+	result, err := trakt.PollDeviceToken(code)
+	assert.Nil(t, err)
+	assert.Equal(t, "access1", result["access_token"])
+
+	server.Respond(http.MethodPost, "/oauth/device/token", 418, nil)
+	_, err = trakt.PollDeviceToken(code)
+	assert.EqualError(t, err, "authorization denied")
+}
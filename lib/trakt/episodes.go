@@ -0,0 +1,131 @@
+package trakt
+
+import (
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// multiEpisodeRegex matches the episodes of a file, e.g. S01E01-E02, S01E01E02E03 or S01E01-02
+var multiEpisodeRegex = regexp.MustCompile(`(?i)S(\d{1,3})E(\d{1,4})(?:-?E|-)(?:\d{1,4}(?:-?E|-))*(\d{1,4})`)
+
+// maxFileEpisodes bounds the episodes of a file, larger ranges are unlikely to be episodes
+const maxFileEpisodes = 10
+
+// fileEpisodes lists the episodes of a file holding several of them, nil
+// otherwise. They are numbered after the episode found for the item, which
+// may differ from the numbering of the file name.
+func fileEpisodes(wh hooks.Webhook, body common.ScrobbleBody) []common.Episode {
+	var file string
+	for _, media := range wh.Extra.Metadata.Media {
+		for _, part := range media.Part {
+			if file == "" {
+				file = part.File
+			}
+		}
+	}
+	match := multiEpisodeRegex.FindStringSubmatch(filepath.Base(file))
+	if match == nil {
+		return nil
+	}
+	season, _ := strconv.Atoi(match[1])
+	first, _ := strconv.Atoi(match[2])
+	last, _ := strconv.Atoi(match[3])
+	count := last - first + 1
+	if count < 2 || count > maxFileEpisodes {
+		return nil
+	}
+	if body.Episode != nil && body.Episode.Season != nil && body.Episode.Number != nil {
+		// the item is one of the episodes of the file, not necessarily the first
+		offset := 0
+		if index := wh.Metadata.Index; index >= first && index <= last {
+			offset = index - first
+		}
+		season, first = *body.Episode.Season, *body.Episode.Number-offset
+	}
+	episodes := make([]common.Episode, count)
+	for i := range episodes {
+		s, n := season, first+i
+		episodes[i] = common.Episode{Season: &s, Number: &n}
+	}
+	return episodes
+}
+
+// resolveEpisodeShow finds the show, season and number of an episode known by
+// its IDs only, which the episodes of its file are numbered after
+func (t *Trakt) resolveEpisodeShow(body *common.ScrobbleBody) bool {
+	if body.Show != nil {
+		return true
+	}
+	if body.Episode == nil || body.Episode.Ids == nil {
+		return false
+	}
+	result, err := t.searchID(*body.Episode.Ids, "episode")
+	if err != nil || result.Episode.Season == nil || result.Episode.Number == nil {
+		log.Printf("Cannot find the show of episode %v: %v", idKeys(*body.Episode.Ids), err)
+		return false
+	}
+	body.Show = &common.Show{Ids: result.Show.Ids}
+	body.Episode = &common.Episode{Season: result.Episode.Season, Number: result.Episode.Number}
+	return true
+}
+
+// splitProgress finds the episode of a file at a progress, and the progress
+// within it, the episodes being assumed to have the same duration
+func splitProgress(progress, episodes int) (part, local int) {
+	part = progress * episodes / 100
+	if part >= episodes {
+		part = episodes - 1
+	}
+	local = progress*episodes - part*100
+	if local > 100 {
+		local = 100
+	}
+	return part, local
+}
+
+// crossEpisodes applies the event of a file holding several episodes to the
+// episode at its progress. The episodes the playback went past since the last
+// event are stopped as watched first. Nothing is known before the first event,
+// which is every event with the stores not caching scrobbles, so the episodes
+// before it are left alone rather than stopped at every event.
+func (t *Trakt) crossEpisodes(pr plexhooks.PlexResponse, user store.User, event string, cache *common.CacheItem, progress int) (string, int) {
+	if len(cache.Episodes) < 2 || cache.Body.Show == nil {
+		return event, progress
+	}
+	part, local := splitProgress(progress, len(cache.Episodes))
+	if part != cache.Part {
+		if part > cache.Part && cache.LastAction != "" {
+			for p := cache.Part; p < part; p++ {
+				if p == cache.Part && cache.LastAction == actionStop {
+					continue
+				}
+				done := *cache
+				done.Trigger = pr.Event
+				done.Part = p
+				done.Body = episodeBody(*cache, p)
+				done.Body.Progress = 100
+				t.scrobbleRequest(actionStop, done, user)
+			}
+		}
+		cache.Part = part
+		cache.Body = episodeBody(*cache, part)
+		cache.LastAction = ""
+	}
+	return eventAction(pr.Event, local, t.threshold(pr, user))
+}
+
+// episodeBody is the scrobble body of an episode of a file
+func episodeBody(cache common.CacheItem, part int) common.ScrobbleBody {
+	episode := cache.Episodes[part]
+	return common.ScrobbleBody{
+		Show:    cache.Body.Show,
+		Episode: &episode,
+	}
+}
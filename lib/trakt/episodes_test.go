@@ -0,0 +1,145 @@
+package trakt
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func newEpisodeWebhook(event string, viewOffset int, file string) hooks.Webhook {
+	wh := newMovieWebhook(event, viewOffset)
+	wh.Metadata.LibrarySectionType = "show"
+	wh.Metadata.Type = "episode"
+	wh.Metadata.ExternalGuid = nil
+	wh.Metadata.Guid = "com.plexapp.agents.thetvdb://81189/1/1?lang=en"
+	wh.Metadata.Index = 1
+	wh.Extra.Metadata.Media = []hooks.Media{{Part: []hooks.Part{{File: file}}}}
+	return wh
+}
+
+func TestSplitProgress(t *testing.T) {
+	part, local := splitProgress(30, 2)
+	assert.Equal(t, []int{0, 60}, []int{part, local})
+	part, local = splitProgress(75, 2)
+	assert.Equal(t, []int{1, 50}, []int{part, local})
+	part, local = splitProgress(100, 3)
+	assert.Equal(t, []int{2, 100}, []int{part, local})
+}
+
+func TestFileEpisodes(t *testing.T) {
+	season, number := 1, 1
+	body := common.ScrobbleBody{Episode: &common.Episode{Season: &season, Number: &number}}
+	assert.Nil(t, fileEpisodes(newEpisodeWebhook("media.play", 0, "/tv/Show/Show - S01E01.mkv"), body))
+	assert.Nil(t, fileEpisodes(newEpisodeWebhook("media.play", 0, ""), body))
+
+	episodes := fileEpisodes(newEpisodeWebhook("media.play", 0, "/tv/Show/Show - s01e01e02e03.mkv"), body)
+	assert.Len(t, episodes, 3)
+	assert.Equal(t, 3, *episodes[2].Number)
+
+	// the second episode of the file, numbered differently on TVDB
+	season, number = 2, 6
+	wh := newEpisodeWebhook("media.play", 0, "/tv/Show/Show - S01E04-05.mkv")
+	wh.Metadata.Index = 5
+	episodes = fileEpisodes(wh, body)
+	assert.Len(t, episodes, 2)
+	assert.Equal(t, []int{2, 5}, []int{*episodes[0].Season, *episodes[0].Number})
+	assert.Equal(t, []int{2, 6}, []int{*episodes[1].Season, *episodes[1].Number})
+}
+
+func TestHandleMultiEpisode(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := New("id", "secret", store.NewRedisStore(store.NewRedisClient(s.Addr(), "")))
+	trakt.BaseURL = server.URL
+	user := store.User{ID: "id123", AccessToken: "access123"}
+	file := "/tv/Breaking Bad/Season 1/Breaking Bad - S01E01-E02.mkv"
+
+	trakt.Handle(newEpisodeWebhook("media.play", 0, file), user)
+	trakt.Handle(newEpisodeWebhook("media.pause", 30, file), user)
+	trakt.Handle(newEpisodeWebhook("media.pause", 75, file), user)
+	trakt.Handle(newEpisodeWebhook("media.scrobble", 95, file), user)
+	trakt.Handle(newEpisodeWebhook("media.stop", 97, file), user)
+
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.JSONEq(t, `{"progress":0,"show":{"ids":{"tvdb":81189}},"episode":{"season":1,"number":1}}`, string(starts[0].Body))
+	pauses := server.CallsTo(http.MethodPost, "/scrobble/pause")
+	assert.Len(t, pauses, 2)
+	assert.JSONEq(t, `{"progress":60,"show":{"ids":{"tvdb":81189}},"episode":{"season":1,"number":1}}`, string(pauses[0].Body))
+	assert.JSONEq(t, `{"progress":50,"show":{"ids":{"tvdb":81189}},"episode":{"season":1,"number":2}}`, string(pauses[1].Body))
+	stops := server.CallsTo(http.MethodPost, "/scrobble/stop")
+	assert.Len(t, stops, 2)
+	assert.JSONEq(t, `{"progress":100,"show":{"ids":{"tvdb":81189}},"episode":{"season":1,"number":1}}`, string(stops[0].Body))
+	assert.JSONEq(t, `{"progress":90,"show":{"ids":{"tvdb":81189}},"episode":{"season":1,"number":2}}`, string(stops[1].Body))
+}
+
+func TestHandleMultiEpisodeFirstEvent(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := New("id", "secret", store.NewRedisStore(store.NewRedisClient(s.Addr(), "")))
+	trakt.BaseURL = server.URL
+	user := store.User{ID: "id123", AccessToken: "access123"}
+
+	trakt.Handle(newEpisodeWebhook("media.pause", 75, "/tv/Breaking Bad - S01E01-E02.mkv"), user)
+
+	// the play may have started anywhere, the first episode isn't assumed watched
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/scrobble/stop"))
+	pauses := server.CallsTo(http.MethodPost, "/scrobble/pause")
+	assert.Len(t, pauses, 1)
+	assert.JSONEq(t, `{"progress":50,"show":{"ids":{"tvdb":81189}},"episode":{"season":1,"number":2}}`, string(pauses[0].Body))
+}
+
+func TestHandleMultiEpisodeExternalGuid(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	search := json.RawMessage(`[{
+		"type": "episode",
+		"episode": {"season": 1, "number": 1, "ids": {"trakt": 73482, "tvdb": 349232}},
+		"show": {"title": "Breaking Bad", "ids": {"trakt": 1388, "tvdb": 81189}}
+	}]`)
+	server.Respond(http.MethodGet, "/search/tvdb/349232", http.StatusOK, search)
+	// the disk store caches nothing, every event is handled as the first one
+	// and the episodes before it are never stopped again and again
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123"}
+	wh := func(event string, viewOffset int) hooks.Webhook {
+		wh := newEpisodeWebhook(event, viewOffset, "/tv/Breaking Bad - S01E01-E02.mkv")
+		wh.Metadata.Guid = "plex://episode/5d9c"
+		wh.Metadata.ExternalGuid = []plexhooks.ExternalGuid{{Id: "tvdb://349232"}}
+		return wh
+	}
+
+	trakt.Handle(wh("media.play", 0), user)
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.JSONEq(t, `{"progress":0,"show":{"ids":{"trakt":1388,"tvdb":81189}},"episode":{"season":1,"number":1}}`, string(starts[0].Body))
+
+	server.Reset()
+	server.Respond(http.MethodGet, "/search/tvdb/349232", http.StatusOK, search)
+	trakt.Handle(wh("media.pause", 75), user)
+	trakt.Handle(wh("media.resume", 75), user)
+	trakt.Handle(wh("media.pause", 80), user)
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/scrobble/stop"))
+	pauses := server.CallsTo(http.MethodPost, "/scrobble/pause")
+	assert.Len(t, pauses, 2)
+	assert.JSONEq(t, `{"progress":50,"show":{"ids":{"trakt":1388,"tvdb":81189}},"episode":{"season":1,"number":2}}`, string(pauses[0].Body))
+	assert.JSONEq(t, `{"progress":60,"show":{"ids":{"trakt":1388,"tvdb":81189}},"episode":{"season":1,"number":2}}`, string(pauses[1].Body))
+}
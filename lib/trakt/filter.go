@@ -0,0 +1,31 @@
+package trakt
+
+import (
+	"strings"
+
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// matchFilter returns the first rule of the user ignoring the webhook
+func matchFilter(pr plexhooks.PlexResponse, filters []store.Filter) *store.Filter {
+	for i, f := range filters {
+		var candidates []string
+		switch f.Field {
+		case store.FilterServer:
+			candidates = []string{pr.Server.Uuid, pr.Server.Title}
+		case store.FilterLibrary:
+			candidates = []string{pr.Metadata.LibrarySectionTitle}
+		case store.FilterPlayer:
+			candidates = []string{pr.Player.Uuid, pr.Player.Title}
+		case store.FilterAccount:
+			candidates = []string{pr.Account.Title}
+		}
+		for _, candidate := range candidates {
+			if candidate != "" && strings.EqualFold(candidate, f.Value) {
+				return &filters[i]
+			}
+		}
+	}
+	return nil
+}
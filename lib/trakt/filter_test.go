@@ -0,0 +1,26 @@
+package trakt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestMatchFilter(t *testing.T) {
+	pr := plexhooks.PlexResponse{
+		Account:  plexhooks.Account{Title: "guest"},
+		Server:   plexhooks.Server{Title: "Office", Uuid: "server1"},
+		Player:   plexhooks.Player{Title: "Living Room", Uuid: "player1"},
+		Metadata: plexhooks.Metadata{LibrarySectionTitle: "Home Videos"},
+	}
+
+	assert.Nil(t, matchFilter(pr, nil))
+	assert.Nil(t, matchFilter(pr, []store.Filter{{Field: store.FilterLibrary, Value: "Kids"}}))
+	assert.Equal(t, &store.Filter{Field: store.FilterLibrary, Value: "home videos"},
+		matchFilter(pr, []store.Filter{{Field: store.FilterLibrary, Value: "home videos"}}))
+	assert.NotNil(t, matchFilter(pr, []store.Filter{{Field: store.FilterServer, Value: "server1"}}))
+	assert.NotNil(t, matchFilter(pr, []store.Filter{{Field: store.FilterPlayer, Value: "Living Room"}}))
+	assert.NotNil(t, matchFilter(pr, []store.Filter{{Field: store.FilterAccount, Value: "Guest"}}))
+}
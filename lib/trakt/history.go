@@ -0,0 +1,57 @@
+package trakt
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// flushHistory adds the queued stops of a user to their history, with the
+// time they were watched at rather than the time they are retried at
+func (t *Trakt) flushHistory(userID string, items []common.QueueItem) {
+	user := t.storage.GetUser(userID)
+	if user == nil {
+		for _, q := range items {
+			log.Printf("Dropping %s, user not found", describeQueued(q))
+			t.storage.DequeueScrobble(q.ID)
+		}
+		return
+	}
+	var sync syncBody
+	var added []common.QueueItem
+	for _, q := range items {
+		if !sync.add(q.Item.Body, syncFields{WatchedAt: q.Created.UTC().Format(time.RFC3339)}) {
+			log.Printf("Dropping %s, %s has no season and number", describeQueued(q), q.Item.Body)
+			t.storage.DequeueScrobble(q.ID)
+			continue
+		}
+		added = append(added, q)
+	}
+	items = added
+	if sync.empty() {
+		return
+	}
+	b, _ := json.Marshal(sync)
+	err := t.syncRequest("/sync/history", user.AccessToken, sync)
+	if err != nil {
+		log.Printf("/sync/history failed (%s): %s", err, string(b))
+		for _, q := range items {
+			t.retryFailed(q, err)
+		}
+		return
+	}
+	log.Printf("Added %d plays to the history: %s", len(items), string(b))
+	for _, q := range items {
+		t.storage.DequeueScrobble(q.ID)
+	}
+}
+
+// historyFallback tells whether a stop rejected by the scrobble API should be
+// added to the history instead, a conflict means it was already scrobbled
+func historyFallback(err error) bool {
+	httpErr, ok := err.(HttpError)
+	return ok && httpErr.Code != http.StatusConflict && httpErr.Code != http.StatusUnauthorized
+}
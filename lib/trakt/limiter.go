@@ -0,0 +1,210 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Trakt allows 1000 calls every 5 minutes per application
+	globalRateLimit  = 1000
+	globalRatePeriod = 5 * time.Minute
+	// and one POST, PUT or DELETE per second per user
+	userRateLimit  = 1
+	userRatePeriod = time.Second
+
+	// rateLimitMaxWait is the longest a call waits for the limits to clear
+	// before failing, the scrobbles are then retried by the queue
+	rateLimitMaxWait = 30 * time.Second
+	// rateLimitLowWater is the share of the global bucket below which the limiter is reported as saturated
+	rateLimitLowWater = 0.1
+)
+
+// bucket is a token bucket, reservations may take it below zero so that the
+// waiting calls are served in order instead of being dropped
+type bucket struct {
+	capacity float64
+	tokens   float64
+	// rate is the number of tokens refilled per second
+	rate float64
+	last time.Time
+	// blockedUntil is set from the Retry-After and X-Ratelimit headers
+	blockedUntil time.Time
+}
+
+func newBucket(limit int, period time.Duration, now time.Time) *bucket {
+	return &bucket{
+		capacity: float64(limit),
+		tokens:   float64(limit),
+		rate:     float64(limit) / period.Seconds(),
+		last:     now,
+	}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+	}
+}
+
+// reserve takes a token and returns how long to wait before using it
+func (b *bucket) reserve(now time.Time) time.Duration {
+	b.refill(now)
+	b.tokens--
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	if blocked := b.blockedUntil.Sub(now); blocked > wait {
+		wait = blocked
+	}
+	return wait
+}
+
+// limiter shares the Trakt rate limits between every call of the instance
+type limiter struct {
+	mu      sync.Mutex
+	global  *bucket
+	users   map[string]*bucket
+	waiting int
+}
+
+func newLimiter() *limiter {
+	return &limiter{
+		global: newBucket(globalRateLimit, globalRatePeriod, time.Now()),
+		users:  make(map[string]*bucket),
+	}
+}
+
+// wait blocks until the call may be sent, the calls modifying data are also
+// limited per user, who is identified by their access token. It fails with a
+// 429 rather than waiting longer than rateLimitMaxWait.
+func (l *limiter) wait(method, accessToken string) error {
+	l.mu.Lock()
+	now := time.Now()
+	buckets := []*bucket{l.global}
+	if accessToken != "" && method != http.MethodGet {
+		buckets = append(buckets, l.user(accessToken, now))
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.reserve(now); w > wait {
+			wait = w
+		}
+	}
+	if wait > rateLimitMaxWait {
+		// the call isn't sent, the next ones may use its tokens
+		for _, b := range buckets {
+			b.tokens++
+		}
+		l.mu.Unlock()
+		return NewHttpError(http.StatusTooManyRequests, fmt.Sprintf("rate limited for %s", wait.Round(time.Second)))
+	}
+	if wait <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.waiting++
+	waiting := l.waiting
+	l.mu.Unlock()
+
+	if wait > time.Second {
+		log.Printf("Waiting %s for the Trakt rate limit (%d calls waiting)", wait.Round(time.Second), waiting)
+	}
+	time.Sleep(wait)
+
+	l.mu.Lock()
+	l.waiting--
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *limiter) user(accessToken string, now time.Time) *bucket {
+	b, ok := l.users[accessToken]
+	if !ok {
+		// forget the idle users, their buckets are full again
+		for token, user := range l.users {
+			if now.Sub(user.last) > userRatePeriod && now.After(user.blockedUntil) {
+				delete(l.users, token)
+			}
+		}
+		b = newBucket(userRateLimit, userRatePeriod, now)
+		l.users[accessToken] = b
+	}
+	return b
+}
+
+// rateLimitHeader is the X-Ratelimit header Trakt sends along with a 429
+type rateLimitHeader struct {
+	Name      string    `json:"name"`
+	Remaining int       `json:"remaining"`
+	Until     time.Time `json:"until"`
+}
+
+// update blocks the calls until the limit reported by a response is reset,
+// it returns how long that is
+func (l *limiter) update(resp *http.Response, accessToken string) time.Duration {
+	now := time.Now()
+	var until time.Time
+	var header rateLimitHeader
+	if err := json.Unmarshal([]byte(resp.Header.Get("X-Ratelimit")), &header); err == nil && header.Remaining <= 0 {
+		until = header.Until
+	}
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			until = now.Add(time.Duration(seconds) * time.Second)
+		} else if until.IsZero() {
+			until = now.Add(userRatePeriod)
+		}
+	}
+	if !until.After(now) {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.global
+	if accessToken != "" && (header.Name == "AUTHED_API_POST_LIMIT" || header.Name == "") && resp.Request.Method != http.MethodGet {
+		b = l.user(accessToken, now)
+	}
+	if until.After(b.blockedUntil) {
+		b.blockedUntil = until
+	}
+	name := header.Name
+	if name == "" {
+		name = resp.Status
+	}
+	log.Printf("Trakt rate limit reached (%s), calls blocked until %s", name, until.Format(time.RFC3339))
+	return until.Sub(now)
+}
+
+// status describes the saturation of the limiter, it returns nil when calls go through freely
+func (l *limiter) status() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.global.refill(now)
+	switch {
+	case now.Before(l.global.blockedUntil):
+		return fmt.Errorf("rate limited until %s, %d calls waiting", l.global.blockedUntil.Format(time.RFC3339), l.waiting)
+	case l.waiting > 0:
+		return fmt.Errorf("%d calls waiting, %d of %d calls left", l.waiting, int(l.global.tokens), globalRateLimit)
+	case l.global.tokens < l.global.capacity*rateLimitLowWater:
+		return fmt.Errorf("%d of %d calls left", int(l.global.tokens), globalRateLimit)
+	}
+	return nil
+}
+
+// RateLimitStatus describes the saturation of the Trakt rate limits, it returns nil when calls go through freely
+func (t *Trakt) RateLimitStatus() error {
+	return t.limiter.status()
+}
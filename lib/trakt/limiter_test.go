@@ -0,0 +1,92 @@
+package trakt
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func TestBucketReserve(t *testing.T) {
+	now := time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC)
+	b := newBucket(2, time.Second, now)
+
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, time.Duration(0), b.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now))
+	assert.Equal(t, time.Second, b.reserve(now))
+	assert.Equal(t, 500*time.Millisecond, b.reserve(now.Add(time.Second)))
+
+	b.blockedUntil = now.Add(time.Minute)
+	assert.Equal(t, 58*time.Second, b.reserve(now.Add(2*time.Second)))
+}
+
+func TestLimiterUpdate(t *testing.T) {
+	l := newLimiter()
+	resp := &http.Response{
+		StatusCode: http.StatusTooManyRequests,
+		Header:     http.Header{"Retry-After": {"10"}},
+		Request:    &http.Request{Method: http.MethodPost},
+	}
+	wait := l.update(resp, "access123")
+	assert.InDelta(t, float64(10*time.Second), float64(wait), float64(time.Second))
+	assert.True(t, l.users["access123"].blockedUntil.After(time.Now()))
+	assert.Nil(t, l.status())
+
+	resp.Header = http.Header{
+		"Retry-After": {"20"},
+		"X-Ratelimit": {`{"name":"UNAUTHED_API_GET_LIMIT","period":300,"limit":1000,"remaining":0,"until":"2030-01-01T00:00:00Z"}`},
+	}
+	resp.Request.Method = http.MethodGet
+	l.update(resp, "access123")
+	assert.Contains(t, l.status().Error(), "rate limited until")
+
+	resp.StatusCode = http.StatusOK
+	resp.Header = http.Header{}
+	assert.Equal(t, time.Duration(0), l.update(resp, "access123"))
+}
+
+func TestLimiterWait(t *testing.T) {
+	l := newLimiter()
+	assert.Nil(t, l.wait(http.MethodPost, "access123"))
+
+	l.global.blockedUntil = time.Now().Add(time.Hour)
+	tokens := l.global.tokens
+	err := l.wait(http.MethodGet, "")
+	assert.True(t, retryable(err))
+	assert.Contains(t, err.Error(), "rate limited for")
+	assert.InDelta(t, tokens, l.global.tokens, 0.1)
+	assert.Equal(t, 0, l.waiting)
+}
+
+func TestHandleRateLimited(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	storage := store.NewRedisStore(store.NewRedisClient(s.Addr(), ""))
+	trakt := New("id", "secret", storage)
+	trakt.BaseURL = server.URL
+	trakt.limiter.global.blockedUntil = time.Now().Add(time.Hour)
+
+	trakt.Handle(newMovieWebhook("media.stop", 95), store.User{ID: "id123", AccessToken: "access123"})
+	assert.Empty(t, server.Calls())
+	queue := storage.GetScrobbleQueue()
+	assert.Len(t, queue, 1)
+	assert.Equal(t, actionStop, queue[0].Action)
+	assert.Contains(t, queue[0].LastError, "rate limited for")
+}
+
+func TestLimiterStatus(t *testing.T) {
+	l := newLimiter()
+	assert.Nil(t, l.status())
+	l.global.tokens = 50
+	assert.EqualError(t, l.status(), "50 of 1000 calls left")
+}
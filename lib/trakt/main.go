@@ -15,6 +15,8 @@ import (
 	"time"
 
 	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/plex"
 	"github.com/xanderstrike/goplaxt/lib/store"
 	"github.com/xanderstrike/plexhooks"
 )
@@ -25,6 +27,11 @@ const (
 	IMDBService       = "imdb"
 
 	ProgressThreshold = 90
+	// MinProgressThreshold is the lowest threshold, Trakt records the stops below it as pauses
+	MinProgressThreshold = 80
+
+	// DefaultBaseURL is the production Trakt API
+	DefaultBaseURL = "https://api.trakt.tv"
 
 	actionStart = "start"
 	actionPause = "pause"
@@ -33,16 +40,20 @@ const (
 
 func New(clientId, clientSecret string, storage store.Store) *Trakt {
 	return &Trakt{
-		ClientId:     clientId,
-		clientSecret: clientSecret,
-		storage:      storage,
-		httpClient:   &http.Client{Timeout: time.Second * 10},
-		ml:           common.NewMultipleLock(),
+		ClientId:          clientId,
+		ProgressThreshold: ProgressThreshold,
+		BaseURL:           DefaultBaseURL,
+		PlexMetadataURL:   plex.MetadataProviderURL,
+		clientSecret:      clientSecret,
+		storage:           storage,
+		httpClient:        &http.Client{Timeout: time.Second * 10},
+		ml:                common.NewMultipleLock(),
+		limiter:           newLimiter(),
 	}
 }
 
 // AuthRequest authorize the connection with Trakt
-func (t *Trakt) AuthRequest(root, username, code, refreshToken, grantType string) (map[string]interface{}, bool) {
+func (t *Trakt) AuthRequest(root, username, code, refreshToken, grantType string) (map[string]interface{}, error) {
 	values := map[string]string{
 		"code":          code,
 		"refresh_token": refreshToken,
@@ -53,41 +64,127 @@ func (t *Trakt) AuthRequest(root, username, code, refreshToken, grantType string
 	}
 	jsonValue, _ := json.Marshal(values)
 
-	resp, err := t.httpClient.Post("https://api.trakt.tv/oauth/token", "application/json", bytes.NewBuffer(jsonValue))
-	handleErr(err)
+	if err := t.limiter.wait(http.MethodPost, ""); err != nil {
+		return nil, err
+	}
+	resp, err := t.httpClient.Post(t.BaseURL+"/oauth/token", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return nil, err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+	t.limiter.update(resp, "")
+
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("Got a %s error while authorizing :(", resp.Status)
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&oauthErr)
+		if oauthErr.Error == "" {
+			oauthErr.Error = fmt.Sprintf("status code: %d", resp.StatusCode)
+		}
+		return nil, NewHttpError(resp.StatusCode, oauthErr.Error)
+	}
 
 	var result map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result, err
+}
 
+// RevokedGrant tells whether an AuthRequest failed because the user revoked
+// goplaxt or the refresh token is no longer valid, rather than a transient error
+func RevokedGrant(err error) bool {
+	httpErr, ok := err.(HttpError)
+	return ok && (httpErr.Code == http.StatusUnauthorized || httpErr.Message == "invalid_grant")
+}
+
+// RevokeToken invalidates an access token, along with its refresh token
+func (t *Trakt) RevokeToken(accessToken string) error {
+	values := map[string]string{
+		"token":         accessToken,
+		"client_id":     t.ClientId,
+		"client_secret": t.clientSecret,
+	}
+	jsonValue, _ := json.Marshal(values)
+
+	if err := t.limiter.wait(http.MethodPost, ""); err != nil {
+		return err
+	}
+	resp, err := t.httpClient.Post(t.BaseURL+"/oauth/revoke", "application/json", bytes.NewBuffer(jsonValue))
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	t.limiter.update(resp, "")
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("Got a %s error while refreshing :(", resp.Status)
-		return result, false
+		return NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
 	}
+	return nil
+}
 
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	handleErr(err)
+// UserSlug identifies the Trakt account of an access token
+func (t *Trakt) UserSlug(accessToken string) (string, error) {
+	var settings struct {
+		User struct {
+			Ids common.Ids `json:"ids"`
+		} `json:"user"`
+	}
+	if err := t.getJSON("/users/settings", accessToken, &settings); err != nil {
+		return "", err
+	}
+	if settings.User.Ids.Slug == nil {
+		return "", fmt.Errorf("no user slug")
+	}
+	return *settings.User.Ids.Slug, nil
+}
 
-	return result, true
+// TokenExpiry reads when the access token of an AuthRequest result expires
+func TokenExpiry(result map[string]interface{}) time.Time {
+	createdAt, _ := result["created_at"].(float64)
+	expiresIn, ok := result["expires_in"].(float64)
+	if createdAt == 0 || !ok {
+		// assume the shortest lifetime Trakt gives
+		return time.Now().Add(24 * time.Hour)
+	}
+	return time.Unix(int64(createdAt), 0).Add(time.Duration(expiresIn) * time.Second)
 }
 
 // Handle determine if an item is a show or a movie
-func (t *Trakt) Handle(pr plexhooks.PlexResponse, user store.User) {
+func (t *Trakt) Handle(wh hooks.Webhook, user store.User) {
+	pr := wh.PlexResponse
+	if pr.Event == "media.rate" {
+		t.rate(wh, user)
+		return
+	}
+	if pr.Event == "library.new" {
+		t.collect(wh, user)
+		return
+	}
 	if pr.Player.Uuid == "" || pr.Metadata.RatingKey == "" {
 		log.Printf("Event %s ignored", pr.Event)
 		return
 	}
+	if f := matchFilter(pr, user.Filters); f != nil {
+		log.Printf("Event %s ignored by rule %s", pr.Event, f)
+		return
+	}
 	lockKey := fmt.Sprintf("%s:%s", pr.Player.Uuid, pr.Metadata.RatingKey)
 	t.ml.Lock(lockKey)
 	defer t.ml.Unlock(lockKey)
 
-	event, cache, progress := t.getAction(pr)
+	event, cache, progress := t.getAction(pr, user)
 	itemChanged := true
 	if event == "" {
 		log.Printf("Event %s ignored", pr.Event)
 		return
 	} else if cache.ServerUuid == pr.Server.Uuid {
 		itemChanged = false
+		event, progress = t.crossEpisodes(pr, user, event, &cache, progress)
 		if cache.LastAction == actionStop ||
-			(cache.LastAction == event && progress == cache.Body.Progress) {
+			(cache.LastAction == event && progress == cache.Body.Progress) ||
+			(cache.LastAction == actionStart && pr.Event == "media.resume") {
 			log.Print("Event already scrobbled")
 			return
 		}
@@ -97,13 +194,13 @@ func (t *Trakt) Handle(pr plexhooks.PlexResponse, user store.User) {
 		var body *common.ScrobbleBody
 		switch pr.Metadata.LibrarySectionType {
 		case "show":
-			body = t.handleShow(pr)
+			body = t.handleShow(wh, user)
 			if body == nil {
 				log.Print("Cannot find episode")
 				return
 			}
 		case "movie":
-			body = t.handleMovie(pr)
+			body = t.handleMovie(pr, user)
 			if body == nil {
 				log.Print("Cannot find movie")
 				return
@@ -112,64 +209,94 @@ func (t *Trakt) Handle(pr plexhooks.PlexResponse, user store.User) {
 			log.Print("Event ignored")
 			return
 		}
+		cache.Episodes = fileEpisodes(wh, *body)
+		if len(cache.Episodes) > 1 && body.Show == nil {
+			// the episodes of the file are scrobbled along with their show
+			if t.resolveEpisodeShow(body) {
+				cache.Episodes = fileEpisodes(wh, *body)
+			} else {
+				log.Print("Scrobbling the episodes of the file as one")
+				cache.Episodes = nil
+			}
+		}
 		cache.Body = *body
+		cache.Part = 0
+		cache.LastAction = ""
+		event, progress = t.crossEpisodes(pr, user, event, &cache, progress)
 	}
 
+	cache.UserID = user.ID
+	// a play in progress ends the way it started, whatever the mode is now
+	if cache.LastAction == "" || cache.Mode == "" {
+		cache.Mode = store.ModeScrobble
+		if user.Mode == store.ModeCheckin {
+			cache.Mode = store.ModeCheckin
+		}
+	}
 	cache.PlayerUuid = pr.Player.Uuid
 	cache.ServerUuid = pr.Server.Uuid
 	cache.RatingKey = pr.Metadata.RatingKey
 	cache.Trigger = pr.Event
 	cache.Body.Progress = progress
-	t.scrobbleRequest(event, cache, user.AccessToken)
+	t.scrobbleRequest(event, cache, user)
 }
 
-func (t *Trakt) handleShow(pr plexhooks.PlexResponse) *common.ScrobbleBody {
-	if len(pr.Metadata.ExternalGuid) > 0 {
-		isValid := false
-		ids := common.Ids{}
-		for _, guid := range pr.Metadata.ExternalGuid {
-			if len(guid.Id) < 8 {
-				continue
-			}
-			switch guid.Id[:4] {
-			case TheMovieDbService:
-				id, err := strconv.Atoi(guid.Id[7:])
-				if err != nil {
-					continue
-				}
-				ids.Tmdb = &id
-				isValid = true
-			case TheTVDBService:
-				id, err := strconv.Atoi(guid.Id[7:])
-				if err != nil {
-					continue
-				}
-				ids.Tvdb = &id
-				isValid = true
-			case IMDBService:
-				id := guid.Id[7:]
-				ids.Imdb = &id
-				isValid = true
-			}
+func (t *Trakt) handleShow(wh hooks.Webhook, user store.User) *common.ScrobbleBody {
+	pr := wh.PlexResponse
+	if ids, isValid := parseGuids(t.externalGuids(pr, user)); isValid {
+		return &common.ScrobbleBody{
+			Episode: &common.Episode{
+				Ids: &ids,
+			},
 		}
-		if isValid {
-			return &common.ScrobbleBody{
-				Episode: &common.Episode{
-					Ids: &ids,
-				},
-			}
+	}
+	if ids, isValid := t.showIds(wh, user); isValid && pr.Metadata.Index > 0 {
+		// the episode is known by its number in the show
+		season, number := pr.Metadata.ParentIndex, pr.Metadata.Index
+		return &common.ScrobbleBody{
+			Show:    &common.Show{Ids: ids},
+			Episode: &common.Episode{Season: &season, Number: &number},
 		}
 	}
-	return t.findEpisode(pr)
+	body := t.findEpisode(pr)
+	if body == nil || !t.resolveAbsolute(body) {
+		return nil
+	}
+	return body
 }
 
-func (t *Trakt) handleMovie(pr plexhooks.PlexResponse) *common.ScrobbleBody {
-	if len(pr.Metadata.ExternalGuid) == 0 {
-		return nil
+// showIds are the IDs of the show of an episode, the new agent's plex://
+// guid of the show is resolved like the episode's
+func (t *Trakt) showIds(wh hooks.Webhook, user store.User) (common.Ids, bool) {
+	guid := wh.Extra.Metadata.GrandparentGuid
+	if strings.HasPrefix(guid, "plex://") {
+		return parseGuids(t.plexGuidIds(guid, wh.Metadata.GrandparentRatingKey, user))
 	}
-	isValid := false
-	movie := common.Movie{}
-	for _, guid := range pr.Metadata.ExternalGuid {
+	return parseShowGuid(guid)
+}
+
+func (t *Trakt) handleMovie(pr plexhooks.PlexResponse, user store.User) *common.ScrobbleBody {
+	ids, isValid := parseGuids(t.externalGuids(pr, user))
+	if !isValid {
+		movie := t.findAnimeMovie(pr.Metadata.Guid)
+		if movie == nil {
+			movie = t.searchMovie(pr.Metadata.Title, pr.Metadata.Year)
+		}
+		if movie == nil {
+			return nil
+		}
+		return &common.ScrobbleBody{Movie: movie}
+	}
+	return &common.ScrobbleBody{
+		Movie: &common.Movie{
+			Ids: ids,
+		},
+	}
+}
+
+// parseGuids reads the IDs of the new Plex agents, e.g. tmdb://1234
+func parseGuids(guids []plexhooks.ExternalGuid) (ids common.Ids, isValid bool) {
+	for _, guid := range guids {
 		if len(guid.Id) < 8 {
 			continue
 		}
@@ -179,27 +306,50 @@ func (t *Trakt) handleMovie(pr plexhooks.PlexResponse) *common.ScrobbleBody {
 			if err != nil {
 				continue
 			}
-			movie.Ids.Tmdb = &id
+			ids.Tmdb = &id
 			isValid = true
 		case TheTVDBService:
 			id, err := strconv.Atoi(guid.Id[7:])
 			if err != nil {
 				continue
 			}
-			movie.Ids.Tvdb = &id
+			ids.Tvdb = &id
 			isValid = true
 		case IMDBService:
 			id := guid.Id[7:]
-			movie.Ids.Imdb = &id
+			ids.Imdb = &id
 			isValid = true
 		}
 	}
-	if !isValid {
-		return nil
+	return
+}
+
+// parseShowGuid reads the IDs of the guid of a show, e.g. com.plexapp.agents.thetvdb://81189?lang=en or tmdb://1396
+func parseShowGuid(guid string) (ids common.Ids, isValid bool) {
+	u, err := url.Parse(guid)
+	if err != nil || u.Host == "" {
+		return ids, false
 	}
-	return &common.ScrobbleBody{
-		Movie: &movie,
+	switch {
+	case strings.HasSuffix(u.Scheme, "tvdb"):
+		id, err := strconv.Atoi(u.Host)
+		if err != nil {
+			return ids, false
+		}
+		ids.Tvdb = &id
+	case strings.HasSuffix(u.Scheme, "themoviedb"), strings.HasSuffix(u.Scheme, "tmdb"):
+		id, err := strconv.Atoi(u.Host)
+		if err != nil {
+			return ids, false
+		}
+		ids.Tmdb = &id
+	case strings.HasSuffix(u.Scheme, "imdb"):
+		id := u.Host
+		ids.Imdb = &id
+	default:
+		return ids, false
 	}
+	return ids, true
 }
 
 var episodeRegex = regexp.MustCompile(`([0-9]+)/([0-9]+)/([0-9]+)`)
@@ -211,13 +361,20 @@ func (t *Trakt) findEpisode(pr plexhooks.PlexResponse) *common.ScrobbleBody {
 		return nil
 	}
 	var srv string
+	// the HAMA tvdb2 to tvdb4 modes number the episodes from the start of the show
+	var absolute bool
 	if strings.HasSuffix(u.Scheme, "tvdb") {
 		srv = TheTVDBService
 	} else if strings.HasSuffix(u.Scheme, "themoviedb") {
 		srv = TheMovieDbService
 	} else if strings.HasSuffix(u.Scheme, "hama") {
-		if strings.HasPrefix(u.Host, "tvdb-") || strings.HasPrefix(u.Host, "tvdb2-") {
+		if strings.HasPrefix(u.Host, "tvdb-") {
 			srv = TheTVDBService
+		} else if strings.HasPrefix(u.Host, "tvdb2-") || strings.HasPrefix(u.Host, "tvdb3-") || strings.HasPrefix(u.Host, "tvdb4-") {
+			srv = TheTVDBService
+			absolute = true
+		} else if strings.HasPrefix(u.Host, "anidb-") {
+			return t.findAnimeEpisode(pr.Metadata.Guid)
 		}
 	}
 	if srv == "" {
@@ -242,76 +399,162 @@ func (t *Trakt) findEpisode(pr plexhooks.PlexResponse) *common.ScrobbleBody {
 		Season: &season,
 		Number: &number,
 	}
+	if absolute {
+		episode = common.Episode{NumberAbs: &number}
+	}
 	return &common.ScrobbleBody{
 		Show:    &show,
 		Episode: &episode,
 	}
 }
 
-func (t *Trakt) scrobbleRequest(action string, item common.CacheItem, accessToken string) {
-	URL := fmt.Sprintf("https://api.trakt.tv/scrobble/%s", action)
-
-	body, _ := json.Marshal(item.Body)
-	req, err := http.NewRequest("POST", URL, bytes.NewBuffer(body))
-	handleErr(err)
+func (t *Trakt) scrobbleRequest(action string, item common.CacheItem, user store.User) {
+	recorded, err := t.send(action, &item, user.AccessToken)
+	if err != nil {
+		body, _ := json.Marshal(item.Body)
+		log.Printf("%s failed (triggered by: %s, %s)", string(body), item.Trigger, err)
+		if action == actionStop && (retryable(err) || historyFallback(err)) {
+			t.enqueueScrobble(action, item, err)
+		} else if item.Mode != store.ModeCheckin && retryable(err) {
+			// a late check-in is pointless, it would show an outdated "watching now"
+			t.enqueueScrobble(action, item, err)
+		}
+		return
+	}
+	item.LastAction = recorded
+	t.storage.WriteScrobbleBody(item)
+	t.supersedeQueue(item)
+	switch recorded {
+	case actionStart:
+		log.Printf("%s started (triggered by: %s)", item.Body, item.Trigger)
+	case actionPause:
+		if action == actionStop {
+			log.Printf("%s stopped but recorded as paused by Trakt (triggered by: %s)", item.Body, item.Trigger)
+			return
+		}
+		log.Printf("%s paused (triggered by: %s)", item.Body, item.Trigger)
+	case actionStop:
+		log.Printf("%s stopped (triggered by: %s)", item.Body, item.Trigger)
+		// getAction only stops the plays past the threshold
+		if user.WatchlistCleanup {
+			t.cleanWatchlist(item.Body, user.AccessToken)
+		}
+	}
+}
 
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-	req.Header.Add("trakt-api-version", "2")
-	req.Header.Add("trakt-api-key", t.ClientId)
+// send reports an action through the check-in API or the scrobble API,
+// depending on the mode of the item, and returns the action Trakt recorded
+func (t *Trakt) send(action string, item *common.CacheItem, accessToken string) (string, error) {
+	if item.Mode == store.ModeCheckin {
+		return action, t.sendCheckin(action, item, accessToken)
+	}
+	return t.sendScrobble(action, item, accessToken)
+}
 
-	resp, _ := t.httpClient.Do(req)
+// sendScrobble posts the item to the scrobble API and updates it with the
+// response, a stop Trakt didn't count as watched is returned as a pause
+func (t *Trakt) sendScrobble(action string, item *common.CacheItem, accessToken string) (string, error) {
+	body, _ := json.Marshal(item.Body)
+	resp, err := t.request(http.MethodPost, fmt.Sprintf("/scrobble/%s", action), accessToken, body)
+	if err != nil {
+		return "", err
+	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
 
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated {
-		item.LastAction = action
-		respBody, _ := io.ReadAll(resp.Body)
-		_ = json.Unmarshal(respBody, &item.Body)
-		t.storage.WriteScrobbleBody(item)
-		switch action {
-		case actionStart:
-			log.Printf("%s started (triggered by: %s)", item.Body, item.Trigger)
-		case actionPause:
-			log.Printf("%s paused (triggered by: %s)", item.Body, item.Trigger)
-		case actionStop:
-			log.Printf("%s stopped (triggered by: %s)", item.Body, item.Trigger)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+	}
+	respBody, _ := io.ReadAll(resp.Body)
+	_ = json.Unmarshal(respBody, &item.Body)
+	var recorded struct {
+		Action string `json:"action"`
+	}
+	_ = json.Unmarshal(respBody, &recorded)
+	if action == actionStop && recorded.Action == actionPause {
+		return actionPause, nil
+	}
+	return action, nil
+}
+
+// request sends an authenticated call to the Trakt API within the rate
+// limits, a call hitting them is sent again once they are reset unless that
+// takes too long
+func (t *Trakt) request(method, path, accessToken string, body []byte) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest(method, t.BaseURL+path, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
 		}
-	} else {
-		log.Printf("%s failed (triggered by: %s, status code: %d)", string(body), item.Trigger, resp.StatusCode)
+
+		req.Header.Add("Content-Type", "application/json")
+		if accessToken != "" {
+			req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+		}
+		req.Header.Add("trakt-api-version", "2")
+		req.Header.Add("trakt-api-key", t.ClientId)
+
+		if err := t.limiter.wait(method, accessToken); err != nil {
+			return nil, err
+		}
+		resp, err := t.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		wait := t.limiter.update(resp, accessToken)
+		if resp.StatusCode != http.StatusTooManyRequests || wait > rateLimitMaxWait || attempt == 3 {
+			return resp, nil
+		}
+		_ = resp.Body.Close()
 	}
 }
 
-func (t *Trakt) getAction(pr plexhooks.PlexResponse) (action string, item common.CacheItem, progress int) {
+func (t *Trakt) getAction(pr plexhooks.PlexResponse, user store.User) (action string, item common.CacheItem, progress int) {
+	threshold := t.threshold(pr, user)
 	item = t.storage.GetScrobbleBody(pr.Player.Uuid, pr.Metadata.RatingKey)
 	if pr.Metadata.Duration > 0 {
 		progress = int(math.Round(float64(pr.Metadata.ViewOffset) / float64(pr.Metadata.Duration) * 100.0))
 	} else {
 		progress = item.Body.Progress
 	}
-	switch pr.Event {
+	action, progress = eventAction(pr.Event, progress, threshold)
+	return
+}
+
+// eventAction is the scrobble action of a Plex event at a progress
+func eventAction(event string, progress, threshold int) (string, int) {
+	switch event {
 	case "media.play", "media.resume", "playback.started":
-		action = actionStart
+		return actionStart, progress
 	case "media.pause", "media.stop":
-		if progress >= ProgressThreshold {
-			action = actionStop
-		} else {
-			action = actionPause
+		if progress >= threshold {
+			return actionStop, progress
 		}
+		return actionPause, progress
 	case "media.scrobble":
-		action = actionStop
-		if progress < ProgressThreshold {
-			progress = ProgressThreshold
+		if progress < threshold {
+			progress = threshold
 		}
+		return actionStop, progress
 	}
-	return
+	return "", progress
 }
 
-func handleErr(err error) {
-	if err != nil {
-		panic(err)
+// threshold is the progress after which the item is watched for the user
+func (t *Trakt) threshold(pr plexhooks.PlexResponse, user store.User) int {
+	threshold := user.MovieThreshold
+	if pr.Metadata.LibrarySectionType == "show" {
+		threshold = user.EpisodeThreshold
+	}
+	if threshold <= 0 {
+		threshold = t.ProgressThreshold
+	}
+	if threshold < MinProgressThreshold {
+		// saved before the minimum was enforced
+		return MinProgressThreshold
 	}
+	return threshold
 }
 
 func (e HttpError) Error() string {
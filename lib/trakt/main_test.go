@@ -0,0 +1,244 @@
+package trakt
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func newPlexResponse(event, sectionType string, viewOffset int) plexhooks.PlexResponse {
+	return plexhooks.PlexResponse{
+		Event: event,
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType: sectionType,
+			ViewOffset:         viewOffset,
+			Duration:           100,
+		},
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	result := map[string]interface{}{"created_at": float64(1551052800), "expires_in": float64(86400)}
+	assert.Equal(t, time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC), TokenExpiry(result).UTC())
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), TokenExpiry(nil), time.Minute)
+}
+
+func TestGetActionThreshold(t *testing.T) {
+	trakt := New("id", "secret", store.NewDiskStore())
+	user := store.User{Settings: store.Settings{MovieThreshold: 85, EpisodeThreshold: 95}}
+
+	action, _, _ := trakt.getAction(newPlexResponse("media.stop", "movie", 87), user)
+	assert.Equal(t, actionStop, action)
+	action, _, _ = trakt.getAction(newPlexResponse("media.stop", "show", 87), user)
+	assert.Equal(t, actionPause, action)
+	action, _, progress := trakt.getAction(newPlexResponse("media.scrobble", "show", 50), user)
+	assert.Equal(t, actionStop, action)
+	assert.Equal(t, 95, progress)
+
+	action, _, _ = trakt.getAction(newPlexResponse("media.stop", "movie", 87), store.User{})
+	assert.Equal(t, actionPause, action)
+	trakt.ProgressThreshold = 80
+	action, _, _ = trakt.getAction(newPlexResponse("media.stop", "movie", 87), store.User{})
+	assert.Equal(t, actionStop, action)
+
+	// saved before the minimum was enforced
+	user = store.User{Settings: store.Settings{MovieThreshold: 50}}
+	action, _, _ = trakt.getAction(newPlexResponse("media.stop", "movie", 60), user)
+	assert.Equal(t, actionPause, action)
+}
+
+func newTestTrakt(server *trakttest.Server) *Trakt {
+	t := New("id", "secret", store.NewDiskStore())
+	t.BaseURL = server.URL
+	return t
+}
+
+func newMovieWebhook(event string, viewOffset int) hooks.Webhook {
+	return hooks.Webhook{PlexResponse: plexhooks.PlexResponse{
+		Event:  event,
+		Server: plexhooks.Server{Uuid: "server1"},
+		Player: plexhooks.Player{Uuid: "player1"},
+		Metadata: plexhooks.Metadata{
+			LibrarySectionType: "movie",
+			Type:               "movie",
+			RatingKey:          "42",
+			ExternalGuid:       []plexhooks.ExternalGuid{{Id: "tmdb://603"}},
+			ViewOffset:         viewOffset,
+			Duration:           100,
+		},
+	}}
+}
+
+func TestHandleScrobble(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123"}
+
+	trakt.Handle(newMovieWebhook("media.play", 10), user)
+	trakt.Handle(newMovieWebhook("media.stop", 95), user)
+
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.Equal(t, "access123", starts[0].AccessToken)
+	assert.JSONEq(t, `{"progress":10,"movie":{"ids":{"tmdb":603}}}`, string(starts[0].Body))
+	stops := server.CallsTo(http.MethodPost, "/scrobble/stop")
+	assert.Len(t, stops, 1)
+	assert.JSONEq(t, `{"progress":95,"movie":{"ids":{"tmdb":603}}}`, string(stops[0].Body))
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/sync/watchlist/remove"))
+}
+
+func TestHandleWatchlistCleanup(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123", Settings: store.Settings{WatchlistCleanup: true}}
+
+	trakt.Handle(newMovieWebhook("media.stop", 95), user)
+
+	calls := server.CallsTo(http.MethodPost, "/sync/watchlist/remove")
+	assert.Len(t, calls, 1)
+	assert.JSONEq(t, `{"movies":[{"ids":{"tmdb":603}}]}`, string(calls[0].Body))
+}
+
+func TestHandleStopRecordedAsPause(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123", Settings: store.Settings{WatchlistCleanup: true}}
+
+	server.Respond(http.MethodPost, "/scrobble/stop", http.StatusCreated,
+		json.RawMessage(`{"id":0,"action":"pause","progress":95,"movie":{"ids":{"tmdb":603}}}`))
+	trakt.Handle(newMovieWebhook("media.stop", 95), user)
+
+	assert.Len(t, server.CallsTo(http.MethodPost, "/scrobble/stop"), 1)
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/sync/watchlist/remove"))
+}
+
+func TestHandleCheckin(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123", Settings: store.Settings{Mode: store.ModeCheckin}}
+
+	server.Respond(http.MethodPost, "/checkin", http.StatusConflict, nil)
+	trakt.Handle(newMovieWebhook("media.play", 10), user)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/checkin"), 2)
+	assert.Len(t, server.CallsTo(http.MethodDelete, "/checkin"), 1)
+
+	server.Reset()
+	trakt.Handle(newMovieWebhook("media.pause", 50), user)
+	assert.Empty(t, server.Calls())
+
+	trakt.Handle(newMovieWebhook("media.stop", 95), user)
+	assert.Len(t, server.CallsTo(http.MethodDelete, "/checkin"), 1)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/sync/history"), 1)
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/scrobble/stop"))
+}
+
+func TestHandleModeChange(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := New("id", "secret", store.NewRedisStore(store.NewRedisClient(s.Addr(), "")))
+	trakt.BaseURL = server.URL
+	user := store.User{ID: "id123", AccessToken: "access123", Settings: store.Settings{Mode: store.ModeCheckin}}
+
+	trakt.Handle(newMovieWebhook("media.play", 10), user)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/checkin"), 1)
+
+	// switched to scrobbling while watching, the check-in is still cancelled
+	user.Mode = store.ModeScrobble
+	server.Reset()
+	trakt.Handle(newMovieWebhook("media.stop", 95), user)
+	assert.Len(t, server.CallsTo(http.MethodDelete, "/checkin"), 1)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/sync/history"), 1)
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/scrobble/stop"))
+
+	next := newMovieWebhook("media.play", 10)
+	next.Metadata.RatingKey = "43"
+	trakt.Handle(next, user)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/scrobble/start"), 1)
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/checkin"))
+}
+
+func TestAuthRequestErrors(t *testing.T) {
+	server := trakttest.NewServer()
+	trakt := newTestTrakt(server)
+
+	result, err := trakt.AuthRequest("http://foo.bar", "halkeye", "", "refresh123", "refresh_token")
+	assert.Nil(t, err)
+	assert.Equal(t, "access1", result["access_token"])
+
+	server.Respond(http.MethodPost, "/oauth/token", http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+	_, err = trakt.AuthRequest("http://foo.bar", "halkeye", "", "refresh123", "refresh_token")
+	assert.True(t, RevokedGrant(err))
+
+	server.Respond(http.MethodPost, "/oauth/token", http.StatusUnauthorized, nil)
+	_, err = trakt.AuthRequest("http://foo.bar", "halkeye", "", "refresh123", "refresh_token")
+	assert.True(t, RevokedGrant(err))
+
+	server.Respond(http.MethodPost, "/oauth/token", http.StatusServiceUnavailable, nil)
+	_, err = trakt.AuthRequest("http://foo.bar", "halkeye", "", "refresh123", "refresh_token")
+	assert.EqualError(t, err, "status code: 503")
+	assert.False(t, RevokedGrant(err))
+
+	server.Respond(http.MethodPost, "/oauth/token", http.StatusTooManyRequests, nil)
+	_, err = trakt.AuthRequest("http://foo.bar", "halkeye", "", "refresh123", "refresh_token")
+	assert.False(t, RevokedGrant(err))
+	assert.Contains(t, trakt.RateLimitStatus().Error(), "rate limited until")
+
+	server.Close()
+	_, err = trakt.AuthRequest("http://foo.bar", "halkeye", "", "refresh123", "refresh_token")
+	assert.NotNil(t, err)
+	assert.False(t, RevokedGrant(err))
+}
+
+func TestParseShowGuid(t *testing.T) {
+	ids, ok := parseShowGuid("com.plexapp.agents.thetvdb://81189?lang=en")
+	assert.True(t, ok)
+	assert.Equal(t, 81189, *ids.Tvdb)
+	ids, ok = parseShowGuid("tmdb://1396")
+	assert.True(t, ok)
+	assert.Equal(t, 1396, *ids.Tmdb)
+	ids, ok = parseShowGuid("imdb://tt0903747")
+	assert.True(t, ok)
+	assert.Equal(t, "tt0903747", *ids.Imdb)
+	_, ok = parseShowGuid("plex://show/5d9c086c46115600200aa2fe")
+	assert.False(t, ok)
+	_, ok = parseShowGuid("")
+	assert.False(t, ok)
+}
+
+func TestHandleGrandparentGuid(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123"}
+
+	wh := newMovieWebhook("media.play", 10)
+	wh.Metadata.LibrarySectionType = "show"
+	wh.Metadata.Type = "episode"
+	wh.Metadata.ExternalGuid = nil
+	wh.Metadata.Guid = "plex://episode/5d9c1275e9d5a1001f4d8f29"
+	wh.Metadata.ParentIndex = 2
+	wh.Metadata.Index = 3
+	wh.Extra.Metadata.GrandparentGuid = "com.plexapp.agents.thetvdb://81189?lang=en"
+	trakt.Handle(wh, user)
+
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.JSONEq(t, `{"progress":10,"show":{"ids":{"tvdb":81189}},"episode":{"season":2,"number":3}}`, string(starts[0].Body))
+}
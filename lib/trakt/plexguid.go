@@ -0,0 +1,99 @@
+package trakt
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/plex"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+const (
+	// plexGuidTTL is how long the external IDs of a plex:// guid are cached
+	plexGuidTTL = 24 * time.Hour
+	// plexGuidMissTTL is how long a guid Plex couldn't resolve is left alone
+	plexGuidMissTTL = 15 * time.Minute
+)
+
+// plexGuidCache keeps the external IDs of the plex:// guids, its zero value is ready to use
+type plexGuidCache struct {
+	mu    sync.Mutex
+	guids map[string]cachedGuids
+}
+
+type cachedGuids struct {
+	guids   []plexhooks.ExternalGuid
+	fetched time.Time
+}
+
+// externalGuids are the IDs of an item, looked up from Plex when the new agent didn't send them
+func (t *Trakt) externalGuids(pr plexhooks.PlexResponse, user store.User) []plexhooks.ExternalGuid {
+	if len(pr.Metadata.ExternalGuid) > 0 {
+		return pr.Metadata.ExternalGuid
+	}
+	return t.plexGuidIds(pr.Metadata.Guid, pr.Metadata.RatingKey, user)
+}
+
+// plexGuidIds are the external IDs of a plex:// guid, which Plex is asked for
+// once a while, nil for the other guids or when resolving them is disabled
+func (t *Trakt) plexGuidIds(guid, ratingKey string, user store.User) []plexhooks.ExternalGuid {
+	if !t.ResolvePlexGuids || !strings.HasPrefix(guid, "plex://") {
+		return nil
+	}
+	t.plexGuids.mu.Lock()
+	cached, ok := t.plexGuids.guids[guid]
+	t.plexGuids.mu.Unlock()
+	if ok {
+		ttl := plexGuidTTL
+		if cached.guids == nil {
+			ttl = plexGuidMissTTL
+		}
+		if time.Since(cached.fetched) < ttl {
+			return cached.guids
+		}
+	}
+
+	guids, err := t.resolvePlexGuid(guid, ratingKey, user)
+	if err != nil {
+		// cached as well, so that every webhook of the item doesn't ask Plex again
+		log.Printf("Cannot resolve %s: %s", guid, err)
+	}
+	t.plexGuids.mu.Lock()
+	defer t.plexGuids.mu.Unlock()
+	if t.plexGuids.guids == nil {
+		t.plexGuids.guids = make(map[string]cachedGuids)
+	}
+	t.plexGuids.guids[guid] = cachedGuids{guids: guids, fetched: time.Now()}
+	return guids
+}
+
+// resolvePlexGuid asks the Plex server of the user for the item, and plex.tv
+// when the item comes from another server, e.g. one shared with the user
+func (t *Trakt) resolvePlexGuid(guid, ratingKey string, user store.User) ([]plexhooks.ExternalGuid, error) {
+	if user.PlexURL != "" && user.PlexToken != "" && ratingKey != "" {
+		item, err := plex.New(user.PlexURL, user.PlexToken).Metadata(ratingKey)
+		if err == nil && item.Guid == guid && len(item.ExternalGuid) > 0 {
+			return item.ExternalGuid, nil
+		}
+	}
+	token := user.PlexToken
+	if token == "" {
+		token = t.PlexToken
+	}
+	if token == "" {
+		return nil, fmt.Errorf("no Plex token")
+	}
+	item, err := plex.New(t.PlexMetadataURL, token).Metadata(path.Base(guid))
+	if err != nil {
+		return nil, err
+	}
+	if len(item.ExternalGuid) == 0 {
+		return nil, fmt.Errorf("no external ids")
+	}
+	return item.ExternalGuid, nil
+}
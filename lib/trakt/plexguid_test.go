@@ -0,0 +1,142 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestHandlePlexGuid(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	pms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		if r.Header.Get("X-Plex-Token") != "plex123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/library/metadata/42":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"42","guid":"plex://episode/5d9c","Guid":[{"id":"tvdb://349232"}]}]}}`)
+		case "/library/metadata/43":
+			// another item on this server with the same rating key
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"43","guid":"plex://movie/0000","Guid":[{"id":"tmdb://1"}]}]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer pms.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	trakt.ResolvePlexGuids = true
+	trakt.PlexMetadataURL = pms.URL
+	user := store.User{ID: "id123", AccessToken: "access123", Settings: store.Settings{PlexURL: pms.URL, PlexToken: "plex123"}}
+
+	episode := newMovieWebhook("media.play", 10)
+	episode.Metadata.LibrarySectionType = "show"
+	episode.Metadata.ExternalGuid = nil
+	episode.Metadata.Guid = "plex://episode/5d9c"
+	trakt.Handle(episode, user)
+	trakt.Handle(episode, user)
+
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 2)
+	assert.JSONEq(t, `{"progress":10,"episode":{"ids":{"tvdb":349232}}}`, string(starts[0].Body))
+	assert.Equal(t, 1, requests["/library/metadata/42"])
+
+	// shared with the user: unknown to their server and to plex.tv, asked once
+	movie := newMovieWebhook("media.play", 10)
+	movie.Metadata.RatingKey = "43"
+	movie.Metadata.ExternalGuid = nil
+	movie.Metadata.Guid = "plex://movie/5d77"
+	trakt.Handle(movie, user)
+	trakt.Handle(movie, user)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/scrobble/start"), 2)
+	assert.Equal(t, 1, requests["/library/metadata/43"])
+	assert.Equal(t, 1, requests["/library/metadata/5d77"])
+
+	trakt.ResolvePlexGuids = false
+	episode.Metadata.Guid = "plex://episode/6e0d"
+	trakt.Handle(episode, user)
+	assert.Equal(t, 0, requests["/library/metadata/6e0d"])
+}
+
+func TestHandlePlexShowGuid(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	pms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/library/metadata/1001":
+			// an episode the agent matched without its external IDs
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"1001","guid":"plex://episode/5d9c086c46115600200aa2fe"}]}}`)
+		case "/library/metadata/999":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[{"ratingKey":"999","guid":"plex://show/5d9c0874ffd9ef001e99607a","Guid":[{"id":"imdb://tt0903747"},{"id":"tmdb://1396"},{"id":"tvdb://81189"}]}]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer pms.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	trakt.ResolvePlexGuids = true
+	trakt.PlexMetadataURL = pms.URL
+	user := store.User{ID: "id123", AccessToken: "access123", Settings: store.Settings{PlexURL: pms.URL, PlexToken: "plex123"}}
+
+	payload := []byte(`{
+		"event": "media.play",
+		"user": true,
+		"owner": true,
+		"Account": {"id": 1, "title": "halkeye"},
+		"Server": {"title": "Home", "uuid": "server1"},
+		"Player": {"local": true, "title": "Living Room", "uuid": "player1"},
+		"Metadata": {
+			"librarySectionType": "show",
+			"ratingKey": "1001",
+			"key": "/library/metadata/1001",
+			"parentRatingKey": "1000",
+			"grandparentRatingKey": "999",
+			"guid": "plex://episode/5d9c086c46115600200aa2fe",
+			"parentGuid": "plex://season/602e67e61d3358002c411c6b",
+			"grandparentGuid": "plex://show/5d9c0874ffd9ef001e99607a",
+			"type": "episode",
+			"title": "Cat's in the Bag...",
+			"grandparentTitle": "Breaking Bad",
+			"parentTitle": "Season 1",
+			"index": 2,
+			"parentIndex": 1,
+			"viewOffset": 0,
+			"duration": 2880000
+		}
+	}`)
+	pr, err := plexhooks.ParseWebhook(payload)
+	assert.NoError(t, err)
+	wh := hooks.Webhook{PlexResponse: pr}
+	assert.NoError(t, json.Unmarshal(payload, &wh.Extra))
+
+	trakt.Handle(wh, user)
+	wh.Event = "media.pause"
+	wh.Metadata.ViewOffset = 288000
+	trakt.Handle(wh, user)
+
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.JSONEq(t, `{"progress":0,"show":{"ids":{"imdb":"tt0903747","tmdb":1396,"tvdb":81189}},"episode":{"season":1,"number":2}}`, string(starts[0].Body))
+	assert.Len(t, server.CallsTo(http.MethodPost, "/scrobble/pause"), 1)
+	assert.Equal(t, 1, requests["/library/metadata/999"])
+}
@@ -0,0 +1,174 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+const (
+	// RetryMaxAge is how long a failed stop is retried before being dropped
+	RetryMaxAge = 7 * 24 * time.Hour
+	// retryMaxAgeProgress is how long a failed start or pause is retried,
+	// replaying them later would show stale "watching" states on Trakt
+	retryMaxAgeProgress = time.Hour
+
+	retryBaseDelay = time.Minute
+	retryMaxDelay  = 6 * time.Hour
+)
+
+// RunRetryQueue retries the failed scrobbles every interval, it never returns
+func (t *Trakt) RunRetryQueue(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		common.Safely("Retry queue", t.RetryQueue)
+	}
+}
+
+// RetryQueue sends again every failed scrobble which is due, the stops are
+// added to the history of their user in a single request, except the
+// check-ins which have to be cancelled as well
+func (t *Trakt) RetryQueue() {
+	now := time.Now()
+	stops := make(map[string][]common.QueueItem)
+	for _, q := range t.storage.GetScrobbleQueue() {
+		if now.Sub(q.Created) > queueMaxAge(q.Action) {
+			log.Printf("Dropping %s after %d attempts (last error: %s)", describeQueued(q), q.Attempts, q.LastError)
+			t.storage.DequeueScrobble(q.ID)
+			continue
+		}
+		if now.Before(q.NextAttempt) {
+			continue
+		}
+		if q.Action == actionStop && q.Item.Mode != store.ModeCheckin {
+			stops[q.Item.UserID] = append(stops[q.Item.UserID], q)
+			continue
+		}
+		t.retry(q)
+	}
+	for userID, items := range stops {
+		t.flushHistory(userID, items)
+	}
+}
+
+func (t *Trakt) retry(q common.QueueItem) {
+	lockKey := fmt.Sprintf("%s:%s", q.Item.PlayerUuid, q.Item.RatingKey)
+	t.ml.Lock(lockKey)
+	defer t.ml.Unlock(lockKey)
+
+	user := t.storage.GetUser(q.Item.UserID)
+	if user == nil {
+		log.Printf("Dropping %s, user not found", describeQueued(q))
+		t.storage.DequeueScrobble(q.ID)
+		return
+	}
+	_, err := t.send(q.Action, &q.Item, user.AccessToken)
+	if err == nil {
+		log.Printf("%s retried (action: %s, attempts: %d)", q.Item.Body, q.Action, q.Attempts+1)
+		t.storage.DequeueScrobble(q.ID)
+		return
+	}
+	t.retryFailed(q, err)
+}
+
+// retryFailed schedules the next attempt of a queued item, or drops it when retrying is pointless
+func (t *Trakt) retryFailed(q common.QueueItem, err error) {
+	if !retryable(err) {
+		log.Printf("Dropping %s (%s)", describeQueued(q), err)
+		t.storage.DequeueScrobble(q.ID)
+		return
+	}
+	q.Attempts++
+	q.LastError = err.Error()
+	q.Updated = time.Now()
+	q.NextAttempt = q.Updated.Add(retryDelay(q.Attempts))
+	t.storage.EnqueueScrobble(q)
+}
+
+// enqueueScrobble records a failed scrobble so that it can be retried later
+func (t *Trakt) enqueueScrobble(action string, item common.CacheItem, err error) {
+	now := time.Now()
+	q := common.QueueItem{
+		ID:          queueID(action, item),
+		Action:      action,
+		Item:        item,
+		Attempts:    1,
+		Created:     now,
+		Updated:     now,
+		NextAttempt: now.Add(retryDelay(1)),
+		LastError:   err.Error(),
+	}
+	t.storage.EnqueueScrobble(q)
+	body, _ := json.Marshal(item.Body)
+	log.Printf("%s queued for retry (action: %s)", string(body), action)
+}
+
+// supersedeQueue drops the queued starts and pauses of an item which has been scrobbled since
+func (t *Trakt) supersedeQueue(item common.CacheItem) {
+	t.storage.DequeueScrobble(queueID(actionStart, item))
+	t.storage.DequeueScrobble(queueID(actionPause, item))
+}
+
+// describeQueued names a queued item for the logs, its ID holds the user ID which must not be logged
+func describeQueued(q common.QueueItem) string {
+	return fmt.Sprintf("%s of item %s for %s", q.Action, q.Item.RatingKey, store.RedactID(q.Item.UserID))
+}
+
+func queueID(action string, item common.CacheItem) string {
+	key := item.RatingKey
+	if len(item.Episodes) > 1 {
+		// each episode of a file is scrobbled on its own
+		key = fmt.Sprintf("%s.%d", key, item.Part)
+	}
+	return fmt.Sprintf("%s:%s:%s:%s", item.UserID, item.PlayerUuid, key, action)
+}
+
+func queueMaxAge(action string) time.Duration {
+	if action == actionStop {
+		return RetryMaxAge
+	}
+	return retryMaxAgeProgress
+}
+
+// retryDelay doubles the delay on every attempt
+func retryDelay(attempts int) time.Duration {
+	delay := retryBaseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= retryMaxDelay {
+			return retryMaxDelay
+		}
+	}
+	return delay
+}
+
+// retryable tells whether a failed call may succeed later
+func retryable(err error) bool {
+	httpErr, ok := err.(HttpError)
+	if !ok {
+		return true
+	}
+	return httpErr.Code >= http.StatusInternalServerError ||
+		httpErr.Code == http.StatusTooManyRequests ||
+		httpErr.Code == http.StatusRequestTimeout
+}
+
+// QueueStatus describes the retry queue, it returns nil when the queue is empty
+func QueueStatus(items []common.QueueItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	last := items[0]
+	for _, item := range items[1:] {
+		if item.Updated.After(last.Updated) {
+			last = item
+		}
+	}
+	return fmt.Errorf("%d scrobbles queued, last error: %s", len(items), last.LastError)
+}
@@ -0,0 +1,116 @@
+package trakt
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, time.Minute, retryDelay(1))
+	assert.Equal(t, 2*time.Minute, retryDelay(2))
+	assert.Equal(t, 8*time.Minute, retryDelay(4))
+	assert.Equal(t, retryMaxDelay, retryDelay(50))
+}
+
+func TestRetryable(t *testing.T) {
+	assert.True(t, retryable(errors.New("connection refused")))
+	assert.True(t, retryable(NewHttpError(http.StatusBadGateway, "")))
+	assert.True(t, retryable(NewHttpError(http.StatusTooManyRequests, "")))
+	assert.False(t, retryable(NewHttpError(http.StatusNotFound, "")))
+	assert.False(t, retryable(NewHttpError(http.StatusConflict, "")))
+}
+
+func TestHistoryFallback(t *testing.T) {
+	assert.False(t, historyFallback(errors.New("connection refused")))
+	assert.False(t, historyFallback(NewHttpError(http.StatusConflict, "")))
+	assert.False(t, historyFallback(NewHttpError(http.StatusUnauthorized, "")))
+	assert.True(t, historyFallback(NewHttpError(http.StatusNotFound, "")))
+	assert.True(t, historyFallback(NewHttpError(http.StatusUnprocessableEntity, "")))
+}
+
+func TestRetryQueueCheckin(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	storage := store.NewRedisStore(store.NewRedisClient(s.Addr(), ""))
+	trakt := New("id", "secret", storage)
+	trakt.BaseURL = server.URL
+	storage.WriteUser(store.User{ID: "id123", Username: "halkeye", AccessToken: "access123", Updated: time.Now()})
+	tmdb := 603
+	item := common.CacheItem{
+		UserID:     "id123",
+		PlayerUuid: "player1",
+		RatingKey:  "42",
+		Mode:       store.ModeCheckin,
+		Body:       common.ScrobbleBody{Movie: &common.Movie{Ids: common.Ids{Tmdb: &tmdb}}, Progress: 95},
+	}
+	trakt.enqueueScrobble(actionStop, item, errors.New("connection refused"))
+	queue := storage.GetScrobbleQueue()
+	assert.Len(t, queue, 1)
+	queue[0].NextAttempt = time.Now()
+	storage.EnqueueScrobble(queue[0])
+
+	trakt.RetryQueue()
+	assert.Len(t, server.CallsTo(http.MethodDelete, "/checkin"), 1)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/sync/history"), 1)
+	assert.Empty(t, storage.GetScrobbleQueue())
+}
+
+func TestRetryQueueHistory(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	server.Respond(http.MethodPost, "/sync/history", http.StatusCreated, json.RawMessage(`{
+		"added": {"movies": 0, "episodes": 0},
+		"not_found": {"movies": [{"ids": {"tmdb": 603}}], "shows": [], "episodes": []}
+	}`))
+	storage := store.NewRedisStore(store.NewRedisClient(s.Addr(), ""))
+	trakt := New("id", "secret", storage)
+	trakt.BaseURL = server.URL
+	storage.WriteUser(store.User{ID: "id123", Username: "halkeye", AccessToken: "access123", Updated: time.Now()})
+	tmdb, tvdb := 603, 81189
+	movie := common.CacheItem{UserID: "id123", PlayerUuid: "player1", RatingKey: "42",
+		Body: common.ScrobbleBody{Movie: &common.Movie{Ids: common.Ids{Tmdb: &tmdb}}}}
+	episode := common.CacheItem{UserID: "id123", PlayerUuid: "player1", RatingKey: "43",
+		Body: common.ScrobbleBody{Show: &common.Show{Ids: common.Ids{Tvdb: &tvdb}}, Episode: &common.Episode{}}}
+	for _, item := range []common.CacheItem{movie, episode} {
+		storage.EnqueueScrobble(common.QueueItem{ID: queueID(actionStop, item), Action: actionStop, Item: item, Created: time.Now()})
+	}
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	trakt.RetryQueue()
+	calls := server.CallsTo(http.MethodPost, "/sync/history")
+	assert.Len(t, calls, 1)
+	assert.NotContains(t, string(calls[0].Body), "shows")
+	assert.Empty(t, storage.GetScrobbleQueue())
+	assert.Contains(t, logs.String(), `/sync/history ignored the items Trakt didn't find: {"movies":[{"ids":{"tmdb":603}}]}`)
+}
+
+func TestDescribeQueued(t *testing.T) {
+	item := common.CacheItem{UserID: "0123456789abcdef", PlayerUuid: "player1", RatingKey: "42"}
+	q := common.QueueItem{ID: queueID(actionStop, item), Action: actionStop, Item: item}
+	assert.Equal(t, "stop of item 42 for 0123****", describeQueued(q))
+	assert.Contains(t, q.ID, item.UserID)
+}
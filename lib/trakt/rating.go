@@ -0,0 +1,74 @@
+package trakt
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// rate sends the rating of a media.rate event to Trakt, or removes it when it was cleared in Plex
+func (t *Trakt) rate(wh hooks.Webhook, user store.User) {
+	pr := wh.PlexResponse
+	if f := matchFilter(pr, user.Filters); f != nil {
+		log.Printf("Event %s ignored by rule %s", pr.Event, f)
+		return
+	}
+	var body *common.ScrobbleBody
+	switch pr.Metadata.Type {
+	case "movie":
+		body = t.handleMovie(pr, user)
+	case "episode":
+		body = t.handleShow(wh, user)
+	case "show":
+		if ids, isValid := parseGuids(t.externalGuids(pr, user)); isValid {
+			body = &common.ScrobbleBody{Show: &common.Show{Ids: ids}}
+		}
+	default:
+		log.Printf("Rating of %s ignored", pr.Metadata.Type)
+		return
+	}
+	if body == nil {
+		log.Printf("Cannot find %s to rate", pr.Metadata.Type)
+		return
+	}
+
+	rating := traktRating(wh.UserRating())
+	path := "/sync/ratings"
+	if rating == 0 {
+		path = "/sync/ratings/remove"
+	}
+	var sync syncBody
+	if !sync.add(*body, syncFields{Rating: rating}) {
+		log.Printf("Cannot rate %s without its season and number", pr.Metadata.Type)
+		return
+	}
+	b, _ := json.Marshal(sync)
+	if err := t.syncRequest(path, user.AccessToken, sync); err != nil {
+		log.Printf("%s failed (%s): %s", path, err, string(b))
+		return
+	}
+	if rating == 0 {
+		log.Printf("Rating removed: %s", string(b))
+	} else {
+		log.Printf("Rated %d: %s", rating, string(b))
+	}
+}
+
+// traktRating converts Plex's 0-10 half star rating to Trakt's 1-10 scale,
+// 0 means the rating was removed
+func traktRating(userRating *float32) int {
+	if userRating == nil || *userRating <= 0 {
+		return 0
+	}
+	rating := int(math.Round(float64(*userRating)))
+	if rating < 1 {
+		return 1
+	} else if rating > 10 {
+		return 10
+	}
+	return rating
+}
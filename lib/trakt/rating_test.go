@@ -0,0 +1,40 @@
+package trakt
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+func TestTraktRating(t *testing.T) {
+	rating := func(r float32) *float32 { return &r }
+	assert.Equal(t, 0, traktRating(nil))
+	assert.Equal(t, 0, traktRating(rating(-1)))
+	assert.Equal(t, 0, traktRating(rating(0)))
+	assert.Equal(t, 1, traktRating(rating(0.4)))
+	assert.Equal(t, 1, traktRating(rating(1)))
+	assert.Equal(t, 7, traktRating(rating(7)))
+	assert.Equal(t, 10, traktRating(rating(10)))
+}
+
+func TestSyncBody(t *testing.T) {
+	tmdb, season, number := 935, 1, 2
+	var sync syncBody
+	sync.add(common.ScrobbleBody{Movie: &common.Movie{Ids: common.Ids{Tmdb: &tmdb}}}, syncFields{Rating: 8})
+	sync.add(common.ScrobbleBody{
+		Show:    &common.Show{Ids: common.Ids{Tvdb: &tmdb}},
+		Episode: &common.Episode{Season: &season, Number: &number},
+	}, syncFields{Rating: 6})
+	sync.add(common.ScrobbleBody{Episode: &common.Episode{Ids: &common.Ids{Tmdb: &tmdb}}}, syncFields{})
+	// the whole show must not be rated for an episode without a number
+	assert.False(t, sync.add(common.ScrobbleBody{Show: &common.Show{Ids: common.Ids{Tvdb: &tmdb}}, Episode: &common.Episode{}}, syncFields{Rating: 1}))
+
+	b, _ := json.Marshal(sync)
+	assert.JSONEq(t, `{
+		"movies": [{"ids": {"tmdb": 935}, "rating": 8}],
+		"shows": [{"ids": {"tvdb": 935}, "seasons": [{"number": 1, "episodes": [{"number": 2, "rating": 6}]}]}],
+		"episodes": [{"ids": {"tmdb": 935}}]
+	}`, string(b))
+}
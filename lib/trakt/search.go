@@ -0,0 +1,107 @@
+package trakt
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"unicode"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// searchLimit is the number of candidates considered by a search
+const searchLimit = 10
+
+// searchResult is an item of /search/movie
+type searchResult struct {
+	Score float64      `json:"score"`
+	Movie common.Movie `json:"movie"`
+}
+
+// searchMovie looks a movie up by title and year, for the agents not giving
+// its external IDs, nil unless a single candidate matches
+func (t *Trakt) searchMovie(title string, year int) *common.Movie {
+	if title == "" {
+		return nil
+	}
+	query := url.Values{
+		"query":  {title},
+		"fields": {"title"},
+		"limit":  {fmt.Sprint(searchLimit)},
+	}
+	var results []searchResult
+	if err := t.getJSON("/search/movie?"+query.Encode(), "", &results); err != nil {
+		log.Printf("Cannot search movie %q: %s", title, err)
+		return nil
+	}
+	movie := matchMovie(title, year, results)
+	if movie == nil {
+		var candidates []string
+		for _, result := range results {
+			candidates = append(candidates, describeMovie(result.Movie))
+		}
+		log.Printf("No confident match for movie %q (%d) among [%s]", title, year, strings.Join(candidates, ", "))
+		return nil
+	}
+	log.Printf("Matched movie %q (%d) to %s", title, year, describeMovie(*movie))
+	return movie
+}
+
+// matchMovie picks the candidate with the same title and the closest year,
+// nil when none or several of them fit
+func matchMovie(title string, year int, results []searchResult) *common.Movie {
+	var best *common.Movie
+	bestScore, ties := 0, 0
+	for i := range results {
+		score := movieScore(title, year, results[i].Movie)
+		if score == 0 {
+			continue
+		}
+		if score > bestScore {
+			best, bestScore, ties = &results[i].Movie, score, 1
+		} else if score == bestScore {
+			ties++
+		}
+	}
+	if ties != 1 {
+		return nil
+	}
+	return &common.Movie{Ids: best.Ids}
+}
+
+// movieScore rates how well a candidate fits, 0 when it doesn't: release
+// years often differ by one between the databases
+func movieScore(title string, year int, movie common.Movie) int {
+	if movie.Title == nil || normalizeTitle(*movie.Title) != normalizeTitle(title) {
+		return 0
+	}
+	if year == 0 || movie.Year == nil {
+		return 1
+	}
+	switch *movie.Year - year {
+	case 0:
+		return 3
+	case -1, 1:
+		return 2
+	}
+	return 0
+}
+
+// normalizeTitle ignores the case, punctuation and spacing of a title
+func normalizeTitle(title string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(title), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	}), " ")
+}
+
+func describeMovie(movie common.Movie) string {
+	description := "?"
+	if movie.Title != nil {
+		description = *movie.Title
+	}
+	if movie.Year != nil {
+		description = fmt.Sprintf("%s (%d)", description, *movie.Year)
+	}
+	return description
+}
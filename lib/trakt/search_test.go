@@ -0,0 +1,64 @@
+package trakt
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func newSearchResult(title string, year, traktID int) searchResult {
+	return searchResult{Movie: common.Movie{Title: &title, Year: &year, Ids: common.Ids{Trakt: &traktID}}}
+}
+
+func TestMatchMovie(t *testing.T) {
+	results := []searchResult{
+		newSearchResult("The Thing", 1982, 1),
+		newSearchResult("The Thing", 2011, 2),
+		newSearchResult("The Thing from Another World", 1951, 3),
+	}
+	assert.Equal(t, 1, *matchMovie("The Thing", 1982, results).Ids.Trakt)
+	assert.Equal(t, 2, *matchMovie("the thing", 2012, results).Ids.Trakt)
+	assert.Equal(t, 3, *matchMovie("The Thing From Another World!", 0, results).Ids.Trakt)
+	assert.Nil(t, matchMovie("The Thing", 0, results))
+	assert.Nil(t, matchMovie("The Thing", 1995, results))
+	assert.Nil(t, matchMovie("Thing", 1982, results))
+
+	remakes := []searchResult{newSearchResult("Solaris", 2002, 4), newSearchResult("Solaris", 2002, 5)}
+	assert.Nil(t, matchMovie("Solaris", 2002, remakes))
+}
+
+func TestHandleSearchFallback(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", AccessToken: "access123"}
+	server.Respond(http.MethodGet, "/search/movie", http.StatusOK, []searchResult{
+		newSearchResult("Amélie", 2001, 7),
+		newSearchResult("Amélie from Montmartre", 2001, 8),
+	})
+
+	wh := newMovieWebhook("media.play", 10)
+	wh.Metadata.ExternalGuid = nil
+	wh.Metadata.Guid = "com.plexapp.agents.none://42"
+	wh.Metadata.Title = "Amélie"
+	wh.Metadata.Year = 2001
+	trakt.Handle(wh, user)
+
+	searches := server.CallsTo(http.MethodGet, "/search/movie")
+	assert.Len(t, searches, 1)
+	assert.Contains(t, searches[0].Query, "query=Am%C3%A9lie")
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.JSONEq(t, `{"progress":10,"movie":{"ids":{"trakt":7}}}`, string(starts[0].Body))
+
+	server.Reset()
+	wh.Metadata.RatingKey = "43"
+	wh.Metadata.Title = "Unknown Home Video"
+	trakt.Handle(wh, user)
+	assert.Len(t, server.CallsTo(http.MethodGet, "/search/movie"), 1)
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/scrobble/start"))
+}
@@ -3,16 +3,44 @@ package trakt
 import (
 	"net/http"
 
+	"github.com/xanderstrike/goplaxt/lib/animelist"
 	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
 	"github.com/xanderstrike/goplaxt/lib/store"
 )
 
+// API is the Trakt client the webhook and authorization handlers depend on
+type API interface {
+	AuthRequest(root, username, code, refreshToken, grantType string) (map[string]interface{}, error)
+	RevokeToken(accessToken string) error
+	UserSlug(accessToken string) (string, error)
+	RequestDeviceCode() (DeviceCode, error)
+	PollDeviceToken(code DeviceCode) (map[string]interface{}, error)
+	Handle(wh hooks.Webhook, user store.User)
+	RateLimitStatus() error
+}
+
 type Trakt struct {
-	ClientId     string
+	ClientId string
+	// ProgressThreshold is the default percentage after which a play is watched
+	ProgressThreshold int
+	// BaseURL is the root of the Trakt API, DefaultBaseURL unless testing
+	BaseURL string
+	// AnimeList maps the AniDB IDs of the HAMA agent, nil when not configured
+	AnimeList *animelist.List
+	// ResolvePlexGuids looks up the external IDs of the plex:// items sent without them
+	ResolvePlexGuids bool
+	// PlexMetadataURL is the plex.tv metadata service, plex.MetadataProviderURL unless testing
+	PlexMetadataURL string
+	// PlexToken looks the plex:// guids up on plex.tv for the users without a token of their own
+	PlexToken    string
 	clientSecret string
 	storage      store.Store
 	httpClient   *http.Client
 	ml           common.MultipleLock
+	limiter      *limiter
+	absolute     absoluteCache
+	plexGuids    plexGuidCache
 }
 
 type HttpError struct {
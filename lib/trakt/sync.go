@@ -0,0 +1,135 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// syncBody is the list of items sent to the /sync endpoints
+type syncBody struct {
+	Movies   []syncItem `json:"movies,omitempty"`
+	Shows    []syncItem `json:"shows,omitempty"`
+	Episodes []syncItem `json:"episodes,omitempty"`
+}
+
+type syncItem struct {
+	Ids     common.Ids   `json:"ids"`
+	Seasons []syncSeason `json:"seasons,omitempty"`
+	syncFields
+}
+
+type syncSeason struct {
+	Number   int           `json:"number"`
+	Episodes []syncEpisode `json:"episodes"`
+}
+
+type syncEpisode struct {
+	Number int `json:"number"`
+	syncFields
+}
+
+// syncFields are the values attached to every item of a sync call
+type syncFields struct {
+	Rating    int    `json:"rating,omitempty"`
+	WatchedAt string `json:"watched_at,omitempty"`
+	collectionFields
+}
+
+// collectionFields describe the copy of an item added to the collection
+type collectionFields struct {
+	CollectedAt   string `json:"collected_at,omitempty"`
+	MediaType     string `json:"media_type,omitempty"`
+	Resolution    string `json:"resolution,omitempty"`
+	Hdr           string `json:"hdr,omitempty"`
+	Audio         string `json:"audio,omitempty"`
+	AudioChannels string `json:"audio_channels,omitempty"`
+}
+
+// movieEntry is a movie listed by the /sync endpoints, e.g. /sync/watched/movies
+type movieEntry struct {
+	Movie common.Movie `json:"movie"`
+}
+
+// showEntry is a show listed by the /sync endpoints along with its episodes
+type showEntry struct {
+	Show    common.Show `json:"show"`
+	Seasons []struct {
+		Number   int `json:"number"`
+		Episodes []struct {
+			Number int `json:"number"`
+		} `json:"episodes"`
+	} `json:"seasons"`
+}
+
+// episodes lists the episodes of the show by episodeKey
+func (s showEntry) episodes() map[string]bool {
+	episodes := make(map[string]bool)
+	for _, season := range s.Seasons {
+		for _, episode := range season.Episodes {
+			episodes[episodeKey(season.Number, episode.Number)] = true
+		}
+	}
+	return episodes
+}
+
+// syncResponse is the answer of the /sync endpoints, listing the items Trakt doesn't know
+type syncResponse struct {
+	NotFound syncBody `json:"not_found"`
+}
+
+// add appends the item resolved for a webhook, it returns false when the item
+// is an episode known neither by its number nor by its IDs
+func (b *syncBody) add(body common.ScrobbleBody, fields syncFields) bool {
+	switch {
+	case body.Movie != nil:
+		b.Movies = append(b.Movies, syncItem{Ids: body.Movie.Ids, syncFields: fields})
+	case body.Show != nil && body.Episode != nil && body.Episode.Season != nil && body.Episode.Number != nil:
+		b.Shows = append(b.Shows, syncItem{
+			Ids: body.Show.Ids,
+			Seasons: []syncSeason{{
+				Number:   *body.Episode.Season,
+				Episodes: []syncEpisode{{Number: *body.Episode.Number, syncFields: fields}},
+			}},
+		})
+	case body.Episode != nil && body.Episode.Ids != nil:
+		b.Episodes = append(b.Episodes, syncItem{Ids: *body.Episode.Ids, syncFields: fields})
+	case body.Show != nil && body.Episode == nil:
+		b.Shows = append(b.Shows, syncItem{Ids: body.Show.Ids, syncFields: fields})
+	default:
+		// the whole show would be synced otherwise
+		return false
+	}
+	return true
+}
+
+func (b syncBody) empty() bool {
+	return len(b.Movies) == 0 && len(b.Shows) == 0 && len(b.Episodes) == 0
+}
+
+// syncRequest posts the items to a /sync endpoint, e.g. /sync/ratings, and
+// logs the ones Trakt didn't find
+func (t *Trakt) syncRequest(path, accessToken string, body syncBody) error {
+	b, _ := json.Marshal(body)
+	resp, err := t.request(http.MethodPost, path, accessToken, b)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+	}
+	var response syncResponse
+	if err := json.NewDecoder(resp.Body).Decode(&response); err == nil && !response.NotFound.empty() {
+		notFound, _ := json.Marshal(response.NotFound)
+		log.Printf("%s ignored the items Trakt didn't find: %s", path, string(notFound))
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+// Package trakttest provides an in-process fake of the Trakt API for tests.
+package trakttest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+)
+
+// NewServer starts a fake Trakt API, it must be closed by the caller
+func NewServer() *Server {
+	s := &Server{responses: make(map[string]Response)}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Respond makes the endpoint answer status and the JSON of body instead of its
+// default answer, e.g. Respond("POST", "/scrobble/stop", 409, nil)
+func (s *Server) Respond(method, path string, status int, body interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[method+" "+path] = Response{Status: status, Body: body}
+}
+
+// Calls lists the calls received so far, in order
+func (s *Server) Calls() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Call(nil), s.calls...)
+}
+
+// CallsTo lists the calls received by an endpoint, e.g. CallsTo("POST", "/scrobble/start")
+func (s *Server) CallsTo(method, path string) []Call {
+	var calls []Call
+	for _, c := range s.Calls() {
+		if c.Method == method && c.Path == path {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+// Reset forgets the calls and the responses
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = nil
+	s.responses = make(map[string]Response)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	s.calls = append(s.calls, Call{
+		Method:      r.Method,
+		Path:        r.URL.Path,
+		Query:       r.URL.RawQuery,
+		AccessToken: strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "),
+		Body:        body,
+	})
+	response, ok := s.responses[r.Method+" "+r.URL.Path]
+	s.mu.Unlock()
+
+	if !ok {
+		response = s.defaultResponse(r.Method, r.URL.Path, body)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(response.Status)
+	if response.Body != nil {
+		_ = json.NewEncoder(w).Encode(response.Body)
+	}
+}
+
+// defaultResponse answers like Trakt does to a successful call
+func (s *Server) defaultResponse(method, path string, body []byte) Response {
+	switch {
+	case method == http.MethodPost && path == "/oauth/device/code":
+		return Response{Status: http.StatusOK, Body: map[string]interface{}{
+			"device_code":      "device123",
+			"user_code":        "ABCD1234",
+			"verification_url": "https://trakt.tv/activate",
+			"expires_in":       600,
+			"interval":         1,
+		}}
+	case method == http.MethodPost && (path == "/oauth/token" || path == "/oauth/device/token"):
+		s.mu.Lock()
+		s.tokens++
+		n := s.tokens
+		s.mu.Unlock()
+		return Response{Status: http.StatusOK, Body: map[string]interface{}{
+			"access_token":  fmt.Sprintf("access%d", n),
+			"refresh_token": fmt.Sprintf("refresh%d", n),
+			"token_type":    "bearer",
+			"expires_in":    7776000,
+			"scope":         "public",
+			"created_at":    time.Now().Unix(),
+		}}
+	case method == http.MethodPost && path == "/oauth/revoke":
+		return Response{Status: http.StatusOK, Body: map[string]interface{}{}}
+	case method == http.MethodGet && path == "/users/settings":
+		return Response{Status: http.StatusOK, Body: map[string]interface{}{
+			"user": map[string]interface{}{"username": "halkeye", "ids": map[string]interface{}{"slug": "halkeye"}},
+		}}
+	case method == http.MethodPost && strings.HasPrefix(path, "/scrobble/"):
+		return Response{Status: http.StatusCreated, Body: scrobbleResponse(strings.TrimPrefix(path, "/scrobble/"), body)}
+	case method == http.MethodPost && path == "/checkin":
+		return Response{Status: http.StatusCreated, Body: echo(body)}
+	case method == http.MethodDelete && path == "/checkin":
+		return Response{Status: http.StatusNoContent}
+	case method == http.MethodPost && strings.HasPrefix(path, "/sync/"):
+		return Response{Status: http.StatusCreated, Body: map[string]interface{}{}}
+	case method == http.MethodGet && (strings.HasPrefix(path, "/sync/") || strings.HasPrefix(path, "/search/")):
+		return Response{Status: http.StatusOK, Body: []interface{}{}}
+	}
+	return Response{Status: http.StatusNotFound, Body: map[string]string{"error": "not found"}}
+}
+
+// scrobbleResponse echoes the scrobbled item along with the action Trakt took,
+// a stop below 80% is recorded as a pause
+func scrobbleResponse(action string, body []byte) map[string]interface{} {
+	response := echo(body)
+	if action == "stop" {
+		action = "scrobble"
+		if progress, _ := response["progress"].(float64); progress < 80 {
+			action = "pause"
+		}
+	}
+	response["id"] = 0
+	response["action"] = action
+	return response
+}
+
+func echo(body []byte) map[string]interface{} {
+	response := make(map[string]interface{})
+	_ = json.Unmarshal(body, &response)
+	return response
+}
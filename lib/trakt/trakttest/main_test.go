@@ -0,0 +1,44 @@
+package trakttest
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func post(t *testing.T, url, body string) *http.Response {
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer access123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	resp := post(t, s.URL+"/scrobble/stop", `{"progress":95,"movie":{"ids":{"tmdb":603}}}`)
+	var scrobble map[string]interface{}
+	_ = json.NewDecoder(resp.Body).Decode(&scrobble)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "scrobble", scrobble["action"])
+
+	s.Respond(http.MethodPost, "/scrobble/start", http.StatusServiceUnavailable, nil)
+	resp = post(t, s.URL+"/scrobble/start", `{"progress":0}`)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	calls := s.CallsTo(http.MethodPost, "/scrobble/stop")
+	assert.Len(t, calls, 1)
+	assert.Equal(t, "access123", calls[0].AccessToken)
+	assert.JSONEq(t, `{"progress":95,"movie":{"ids":{"tmdb":603}}}`, string(calls[0].Body))
+	assert.Len(t, s.Calls(), 2)
+
+	s.Reset()
+	assert.Empty(t, s.Calls())
+}
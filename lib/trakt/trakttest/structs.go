@@ -0,0 +1,31 @@
+package trakttest
+
+import (
+	"net/http/httptest"
+	"sync"
+)
+
+// Server is a fake Trakt API recording the calls it receives
+type Server struct {
+	*httptest.Server
+	mu        sync.Mutex
+	calls     []Call
+	responses map[string]Response
+	tokens    int
+}
+
+// Call is a request received by the Server
+type Call struct {
+	Method string
+	Path   string
+	Query  string
+	// AccessToken is the bearer token of the call, empty when it isn't authenticated
+	AccessToken string
+	Body        []byte
+}
+
+// Response replaces the default answer of an endpoint
+type Response struct {
+	Status int
+	Body   interface{}
+}
@@ -0,0 +1,172 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/plex"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// RunWatchedSync marks the items watched on Trakt as played in Plex every interval, it never returns
+func (t *Trakt) RunWatchedSync(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		common.Safely("Watched sync", t.syncWatchedUsers)
+	}
+}
+
+func (t *Trakt) syncWatchedUsers() {
+	for _, user := range t.storage.ListUsers() {
+		if !user.WatchedSync || user.PlexURL == "" || user.PlexToken == "" {
+			continue
+		}
+		if err := t.SyncWatched(user, plex.New(user.PlexURL, user.PlexToken)); err != nil {
+			log.Printf("Watched sync of %s failed: %s", user.Username, err)
+		}
+	}
+}
+
+// SyncWatched marks the movies and episodes the user watched on Trakt as played in Plex
+func (t *Trakt) SyncWatched(user store.User, client *plex.Client) error {
+	var movies []movieEntry
+	if err := t.getJSON("/sync/watched/movies", user.AccessToken, &movies); err != nil {
+		return err
+	}
+	var shows []showEntry
+	if err := t.getJSON("/sync/watched/shows", user.AccessToken, &shows); err != nil {
+		return err
+	}
+	watchedMovies := make(map[string]bool)
+	for _, m := range movies {
+		for _, key := range idKeys(m.Movie.Ids) {
+			watchedMovies[key] = true
+		}
+	}
+	watchedEpisodes := make(map[string]map[string]bool)
+	for _, s := range shows {
+		episodes := s.episodes()
+		for _, key := range idKeys(s.Show.Ids) {
+			watchedEpisodes[key] = episodes
+		}
+	}
+
+	sections, err := client.Sections()
+	if err != nil {
+		return err
+	}
+	marked := 0
+	for _, section := range sections {
+		if section.Type != "movie" && section.Type != "show" {
+			continue
+		}
+		items, err := client.Items(section.Key)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			ids, isValid := parseGuids(item.ExternalGuid)
+			if !isValid {
+				continue
+			}
+			if section.Type == "movie" {
+				if item.ViewCount == 0 && matchIds(ids, watchedMovies) {
+					if err := client.MarkPlayed(item.RatingKey); err != nil {
+						return err
+					}
+					marked++
+				}
+				continue
+			}
+			episodes := showEpisodes(ids, watchedEpisodes)
+			if episodes == nil {
+				continue
+			}
+			n, err := markEpisodes(client, item, episodes)
+			marked += n
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Watched sync of %s marked %d items as played", user.Username, marked)
+	return nil
+}
+
+func markEpisodes(client *plex.Client, show plexhooks.Metadata, watched map[string]bool) (int, error) {
+	episodes, err := client.Episodes(show.RatingKey)
+	if err != nil {
+		return 0, err
+	}
+	marked := 0
+	for _, episode := range episodes {
+		if episode.ViewCount > 0 || !watched[episodeKey(episode.ParentIndex, episode.Index)] {
+			continue
+		}
+		if err := client.MarkPlayed(episode.RatingKey); err != nil {
+			return marked, err
+		}
+		marked++
+	}
+	return marked, nil
+}
+
+// idKeys lists the external IDs of an item, e.g. tmdb:935
+func idKeys(ids common.Ids) []string {
+	var keys []string
+	if ids.Tmdb != nil {
+		keys = append(keys, fmt.Sprintf("%s:%d", TheMovieDbService, *ids.Tmdb))
+	}
+	if ids.Tvdb != nil {
+		keys = append(keys, fmt.Sprintf("%s:%d", TheTVDBService, *ids.Tvdb))
+	}
+	if ids.Imdb != nil {
+		keys = append(keys, fmt.Sprintf("%s:%s", IMDBService, *ids.Imdb))
+	}
+	return keys
+}
+
+func matchIds(ids common.Ids, keys map[string]bool) bool {
+	for _, key := range idKeys(ids) {
+		if keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func showEpisodes(ids common.Ids, shows map[string]map[string]bool) map[string]bool {
+	for _, key := range idKeys(ids) {
+		if episodes, ok := shows[key]; ok {
+			return episodes
+		}
+	}
+	return nil
+}
+
+func episodeKey(season, number int) string {
+	return fmt.Sprintf("%dx%d", season, number)
+}
+
+// getJSON calls the Trakt API and decodes the JSON response in out
+func (t *Trakt) getJSON(path, accessToken string, out interface{}) error {
+	resp, err := t.request(http.MethodGet, path, accessToken, nil)
+	if err != nil {
+		return err
+	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return NewHttpError(resp.StatusCode, fmt.Sprintf("status code: %d", resp.StatusCode))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,95 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/plex"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
+)
+
+func TestMatchIds(t *testing.T) {
+	tmdb := 603
+	imdb := "tt0133093"
+	watched := make(map[string]bool)
+	for _, key := range idKeys(common.Ids{Tmdb: &tmdb, Imdb: &imdb}) {
+		watched[key] = true
+	}
+
+	assert.Equal(t, []string{"tmdb:603", "imdb:tt0133093"}, idKeys(common.Ids{Tmdb: &tmdb, Imdb: &imdb}))
+	assert.True(t, matchIds(common.Ids{Imdb: &imdb}, watched))
+	other := 604
+	assert.False(t, matchIds(common.Ids{Tmdb: &other}, watched))
+	assert.False(t, matchIds(common.Ids{}, watched))
+}
+
+func TestShowEpisodes(t *testing.T) {
+	tvdb := 81189
+	shows := map[string]map[string]bool{
+		"tvdb:81189": {episodeKey(1, 2): true},
+	}
+
+	episodes := showEpisodes(common.Ids{Tvdb: &tvdb}, shows)
+	assert.True(t, episodes[episodeKey(1, 2)])
+	assert.False(t, episodes[episodeKey(2, 1)])
+	assert.Nil(t, showEpisodes(common.Ids{}, shows))
+}
+
+func TestSyncWatched(t *testing.T) {
+	var mu sync.Mutex
+	var marked []string
+	pms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/library/sections":
+			fmt.Fprint(w, `{"MediaContainer":{"Directory":[{"key":"1","type":"movie"},{"key":"2","type":"show"}]}}`)
+		case "/library/sections/1/all":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[
+				{"ratingKey":"100","Guid":[{"id":"tmdb://603"}]},
+				{"ratingKey":"101","viewCount":1,"Guid":[{"id":"tmdb://604"}]},
+				{"ratingKey":"102","Guid":[{"id":"tmdb://605"}]},
+				{"ratingKey":"103"}
+			]}}`)
+		case "/library/sections/2/all":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[
+				{"ratingKey":"200","Guid":[{"id":"tvdb://78874"}]},
+				{"ratingKey":"300","Guid":[{"id":"tvdb://81189"}]}
+			]}}`)
+		case "/library/metadata/200/allLeaves":
+			fmt.Fprint(w, `{"MediaContainer":{"Metadata":[
+				{"ratingKey":"201","parentIndex":1,"index":1},
+				{"ratingKey":"202","parentIndex":1,"index":2},
+				{"ratingKey":"203","parentIndex":1,"index":3,"viewCount":2}
+			]}}`)
+		case "/:/scrobble":
+			assert.Equal(t, "com.plexapp.plugins.library", r.URL.Query().Get("identifier"))
+			mu.Lock()
+			marked = append(marked, r.URL.Query().Get("key"))
+			mu.Unlock()
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer pms.Close()
+	server := trakttest.NewServer()
+	defer server.Close()
+	server.Respond(http.MethodGet, "/sync/watched/movies", http.StatusOK, json.RawMessage(`[
+		{"movie": {"ids": {"trakt": 1, "tmdb": 603}}},
+		{"movie": {"ids": {"trakt": 2, "tmdb": 604}}}
+	]`))
+	server.Respond(http.MethodGet, "/sync/watched/shows", http.StatusOK, json.RawMessage(`[
+		{"show": {"ids": {"trakt": 3, "tvdb": 78874}}, "seasons": [{"number": 1, "episodes": [{"number": 1}, {"number": 3}]}]}
+	]`))
+	trakt := newTestTrakt(server)
+	user := store.User{ID: "id123", Username: "halkeye", AccessToken: "access123"}
+
+	assert.Nil(t, trakt.SyncWatched(user, plex.New(pms.URL, "plex123")))
+	assert.Equal(t, []string{"100", "201"}, marked)
+	assert.Equal(t, "access123", server.CallsTo(http.MethodGet, "/sync/watched/movies")[0].AccessToken)
+}
@@ -0,0 +1,58 @@
+package trakt
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/xanderstrike/goplaxt/lib/common"
+)
+
+// showProgress is the watched progress of a show, from /shows/{id}/progress/watched
+type showProgress struct {
+	Aired     int `json:"aired"`
+	Completed int `json:"completed"`
+}
+
+// cleanWatchlist removes a watched movie or episode from the watchlist, along
+// with its show once every aired episode has been watched. It uses the IDs of
+// the scrobble response, which are the ones Trakt matched.
+func (t *Trakt) cleanWatchlist(body common.ScrobbleBody, accessToken string) {
+	var remove syncBody
+	switch {
+	case body.Movie != nil:
+		remove.Movies = append(remove.Movies, syncItem{Ids: body.Movie.Ids})
+	case body.Episode != nil && body.Episode.Ids != nil:
+		remove.Episodes = append(remove.Episodes, syncItem{Ids: *body.Episode.Ids})
+		if body.Show != nil && t.showCompleted(body.Show.Ids, accessToken) {
+			remove.Shows = append(remove.Shows, syncItem{Ids: body.Show.Ids})
+		}
+	default:
+		return
+	}
+	b, _ := json.Marshal(remove)
+	if err := t.syncRequest("/sync/watchlist/remove", accessToken, remove); err != nil {
+		log.Printf("/sync/watchlist/remove failed (%s): %s", err, string(b))
+		return
+	}
+	log.Printf("Removed from the watchlist: %s", string(b))
+}
+
+// showCompleted tells whether every aired episode of the show has been watched
+func (t *Trakt) showCompleted(ids common.Ids, accessToken string) bool {
+	var id string
+	switch {
+	case ids.Trakt != nil:
+		id = fmt.Sprint(*ids.Trakt)
+	case ids.Slug != nil:
+		id = *ids.Slug
+	default:
+		return false
+	}
+	var progress showProgress
+	if err := t.getJSON(fmt.Sprintf("/shows/%s/progress/watched", id), accessToken, &progress); err != nil {
+		log.Printf("Cannot get the progress of show %s: %s", id, err)
+		return false
+	}
+	return progress.Aired > 0 && progress.Completed >= progress.Aired
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,16 +15,21 @@ import (
 	"net/url"
 	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/etherlabsio/healthcheck"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/xanderstrike/goplaxt/lib/animelist"
+	"github.com/xanderstrike/goplaxt/lib/common"
 	"github.com/xanderstrike/goplaxt/lib/config"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
 	"github.com/xanderstrike/goplaxt/lib/store"
 	"github.com/xanderstrike/goplaxt/lib/trakt"
-	"github.com/xanderstrike/plexhooks"
 	"golang.org/x/sync/singleflight"
 )
 
@@ -30,14 +39,75 @@ var (
 	date     string
 	storage  store.Store
 	apiSf    *singleflight.Group
-	traktSrv *trakt.Trakt
+	traktSrv trakt.API
+
+	deviceMu       sync.Mutex
+	deviceSessions = make(map[string]*deviceSession)
+
+	relinkMu     sync.Mutex
+	relinkStates = make(map[string]relinkState)
+
+	refreshSf singleflight.Group
+	// lastRoot is the SelfRoot of the last request, the redirect URI of background refreshes without PUBLIC_URL
+	lastRoot atomic.Value
+)
+
+const (
+	// refreshMargin is how long before they expire the access tokens are refreshed
+	refreshMargin = 2 * time.Hour
+	// relinkTTL is how long the links authorizing a user again can be used
+	relinkTTL = time.Hour
+	// maxDeviceSessions and maxUserDeviceSessions bound the device authorizations
+	// polling Trakt at once, for the instance and for a username
+	maxDeviceSessions     = 50
+	maxUserDeviceSessions = 3
 )
 
 type AuthorizePage struct {
-	SelfRoot   string
-	Authorized bool
-	URL        string
-	ClientID   string
+	SelfRoot    string
+	Authorized  bool
+	URL         string
+	SettingsURL string
+	ClientID    string
+}
+
+type DevicePage struct {
+	SelfRoot        string
+	Username        string
+	UserCode        string
+	VerificationURL string
+	Interval        int
+	Error           string
+}
+
+// deviceSession is a device authorization waiting for the user to enter the code on Trakt
+type deviceSession struct {
+	Username string
+	State    string
+	Code     trakt.DeviceCode
+	User     *store.User
+	Error    string
+}
+
+// relinkState is the user a state of relinkURLs authorizes again
+type relinkState struct {
+	UserID  string
+	Expires time.Time
+}
+
+type SettingsPage struct {
+	SelfRoot         string
+	Action           string
+	UnlinkURL        string
+	Username         string
+	DefaultThreshold int
+	Filters          string
+	store.Settings
+	// RelinkURL and RelinkDeviceURL are set when the user has to authorize again
+	RelinkURL       string
+	RelinkDeviceURL string
+	Saved           bool
+	Error           string
 }
 
 func SelfRoot(r *http.Request) string {
@@ -61,55 +131,544 @@ func authorize(w http.ResponseWriter, r *http.Request) {
 	username := strings.ToLower(args["username"][0])
 	log.Print(fmt.Sprintf("Handling auth request for %s", username))
 	code := args["code"][0]
-	result, _ := traktSrv.AuthRequest(SelfRoot(r), username, code, "", "authorization_code")
+	lastRoot.Store(SelfRoot(r))
+	result, err := traktSrv.AuthRequest(SelfRoot(r), username, code, "", "authorization_code")
+	if err != nil {
+		log.Printf("Authorization of %s failed: %s", username, err)
+		writeError(w, http.StatusBadGateway, "authorization failed")
+		return
+	}
 
-	user := store.NewUser(username, result["access_token"].(string), result["refresh_token"].(string), storage)
+	user, err := linkUser(username, args.Get("state"), result)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	authorized(w, r, user)
+}
 
-	url := fmt.Sprintf("%s/api?id=%s", SelfRoot(r), user.ID)
+// linkUser stores the tokens of an authorization, in a new user unless state
+// comes from relinkURLs, the user authorizing again keeping their webhook link
+func linkUser(username, state string, result map[string]interface{}) (store.User, error) {
+	accessToken, _ := result["access_token"].(string)
+	refreshToken, _ := result["refresh_token"].(string)
+	if state == "" {
+		user := store.NewUser(username, accessToken, refreshToken, trakt.TokenExpiry(result), storage)
+		log.Print(fmt.Sprintf("Authorized as %s", store.RedactID(user.ID)))
+		return user, nil
+	}
+	id, ok := useRelinkState(state)
+	if !ok {
+		return store.User{}, fmt.Errorf("link expired, open your settings page again")
+	}
+	user := storage.GetUser(id)
+	if user == nil {
+		return store.User{}, fmt.Errorf("id is invalid")
+	}
+	if user.Secret == "" {
+		// anyone knowing the id may have started it, the Trakt account must be the one already linked
+		if err := sameTraktUser(user.AccessToken, accessToken); err != nil {
+			log.Printf("Authorization of %s refused: %s", store.RedactID(user.ID), err)
+			return store.User{}, err
+		}
+	}
+	user.UpdateUser(accessToken, refreshToken, trakt.TokenExpiry(result))
+	log.Print(fmt.Sprintf("Authorized %s again", store.RedactID(user.ID)))
+	if user.Secret == "" {
+		user.RotateSecret()
+		log.Print(fmt.Sprintf("Issued a secret to %s", store.RedactID(user.ID)))
+	}
+	return *user, nil
+}
 
-	log.Print(fmt.Sprintf("Authorized as %s", user.ID))
+// sameTraktUser checks that two access tokens belong to the same Trakt account
+func sameTraktUser(accessToken, otherToken string) error {
+	slug, err := traktSrv.UserSlug(accessToken)
+	if err != nil {
+		return fmt.Errorf("cannot check the Trakt account of this link, authorize from the home page for a new link")
+	}
+	other, err := traktSrv.UserSlug(otherToken)
+	if err != nil {
+		return fmt.Errorf("cannot check the Trakt account")
+	}
+	if slug != other {
+		return fmt.Errorf("the Trakt account isn't the one of this link")
+	}
+	return nil
+}
+
+// secretRequired refuses the links without a secret to the pages managing an
+// account, the users created before secrets existed get one by authorizing again
+func secretRequired(w http.ResponseWriter, r *http.Request, user store.User) bool {
+	if user.Secret != "" {
+		return false
+	}
+	redirect, _ := relinkURLs(SelfRoot(r), user)
+	if r.Method == http.MethodGet {
+		http.Redirect(w, r, redirect, http.StatusSeeOther)
+	} else {
+		writeError(w, http.StatusForbidden, fmt.Sprintf("this link has no secret, authorize again to get one: %s", redirect))
+	}
+	return true
+}
 
+// newRelinkState creates the random state identifying the user authorizing again, see linkUser
+func newRelinkState(user store.User) string {
+	state := randomID()
+	now := time.Now()
+	relinkMu.Lock()
+	defer relinkMu.Unlock()
+	for s, relink := range relinkStates {
+		if now.After(relink.Expires) {
+			delete(relinkStates, s)
+		}
+	}
+	relinkStates[state] = relinkState{UserID: user.ID, Expires: now.Add(relinkTTL)}
+	return state
+}
+
+// useRelinkState finds the user of a state, which can be used once
+func useRelinkState(state string) (string, bool) {
+	relinkMu.Lock()
+	defer relinkMu.Unlock()
+	relink, ok := relinkStates[state]
+	delete(relinkStates, state)
+	if !ok || time.Now().After(relink.Expires) {
+		return "", false
+	}
+	return relink.UserID, true
+}
+
+// randomID is a random hex string, unguessable
+func randomID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// authorized shows the webhook link of a user who just authorized
+func authorized(w http.ResponseWriter, r *http.Request, user store.User) {
 	tmpl := template.Must(template.ParseFiles("static/index.html"))
 	data := AuthorizePage{
-		SelfRoot:   SelfRoot(r),
-		Authorized: true,
-		URL:        url,
-		ClientID:   traktSrv.ClientId,
+		SelfRoot:    SelfRoot(r),
+		Authorized:  true,
+		URL:         webhookURL(SelfRoot(r), user),
+		SettingsURL: settingsURL(SelfRoot(r), user),
+		ClientID:    config.TraktClientId,
 	}
 	tmpl.Execute(w, data)
 }
 
+// device authorizes a user with a code entered on Trakt, for the instances
+// Trakt can't redirect the browser to
+func device(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		username := strings.ToLower(r.FormValue("username"))
+		if username == "" {
+			writeError(w, http.StatusBadRequest, "missing username")
+			return
+		}
+		id, started, err := reserveDeviceSession(username, r.FormValue("state"))
+		if err != nil {
+			writeError(w, http.StatusTooManyRequests, err.Error())
+			return
+		}
+		if started {
+			code, err := traktSrv.RequestDeviceCode()
+			if err != nil {
+				log.Printf("Cannot get a device code: %s", err)
+				deviceMu.Lock()
+				delete(deviceSessions, id)
+				deviceMu.Unlock()
+				writeError(w, http.StatusBadGateway, "cannot get a code from Trakt")
+				return
+			}
+			log.Print(fmt.Sprintf("Handling device auth request for %s", username))
+			startDeviceSession(id, code)
+		}
+		http.Redirect(w, r, fmt.Sprintf("%s/device?session=%s", SelfRoot(r), id), http.StatusSeeOther)
+		return
+	}
+
+	id := r.URL.Query().Get("session")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing session")
+		return
+	}
+
+	deviceMu.Lock()
+	session, ok := deviceSessions[id]
+	var user *store.User
+	var data DevicePage
+	if ok {
+		user = session.User
+		data = DevicePage{
+			SelfRoot:        SelfRoot(r),
+			Username:        session.Username,
+			UserCode:        session.Code.UserCode,
+			VerificationURL: session.Code.VerificationURL,
+			Interval:        session.Code.Interval,
+			Error:           session.Error,
+		}
+	}
+	deviceMu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown session")
+		return
+	}
+	if user != nil {
+		authorized(w, r, *user)
+		return
+	}
+	tmpl := template.Must(template.ParseFiles("static/device.html"))
+	_ = tmpl.Execute(w, data)
+}
+
+// reserveDeviceSession returns the pending session authorizing a username,
+// or reserves a new one while the sessions are within their limits
+func reserveDeviceSession(username, state string) (id string, started bool, err error) {
+	deviceMu.Lock()
+	defer deviceMu.Unlock()
+	pending, userPending := 0, 0
+	for id, session := range deviceSessions {
+		if session.User != nil || session.Error != "" {
+			continue
+		}
+		if session.Username == username {
+			if session.State == state {
+				return id, false, nil
+			}
+			userPending++
+		}
+		pending++
+	}
+	if pending >= maxDeviceSessions {
+		return "", false, errors.New("too many pending authorizations, try again later")
+	}
+	if userPending >= maxUserDeviceSessions {
+		return "", false, fmt.Errorf("too many pending authorizations of %s, try again later", username)
+	}
+	id = randomID()
+	deviceSessions[id] = &deviceSession{Username: username, State: state}
+	return id, true, nil
+}
+
+// startDeviceSession polls Trakt until the code of a reserved session is
+// entered, the session is forgotten a while after it ends
+func startDeviceSession(id string, code trakt.DeviceCode) {
+	deviceMu.Lock()
+	session := deviceSessions[id]
+	session.Code = code
+	username, state := session.Username, session.State
+	deviceMu.Unlock()
+
+	go func() {
+		result, err := traktSrv.PollDeviceToken(code)
+		var user store.User
+		if err == nil {
+			user, err = linkUser(username, state, result)
+		}
+		if err != nil {
+			log.Printf("Device auth of %s failed: %s", username, err)
+		}
+		deviceMu.Lock()
+		if err == nil {
+			session.User = &user
+		} else {
+			session.Error = err.Error()
+		}
+		deviceMu.Unlock()
+		time.AfterFunc(10*time.Minute, func() {
+			deviceMu.Lock()
+			delete(deviceSessions, id)
+			deviceMu.Unlock()
+		})
+	}()
+}
+
+// authorizeCommand authorizes a user from the terminal with a code entered on Trakt
+func authorizeCommand(args []string) int {
+	flags := flag.NewFlagSet("authorize", flag.ExitOnError)
+	root := flags.String("root", "http://localhost:8000", "public URL of this instance, used in the printed links")
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: goplaxt authorize [-root URL] <plex username>")
+		return 2
+	}
+	username := strings.ToLower(flags.Arg(0))
+
+	code, err := traktSrv.RequestDeviceCode()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot get a code from Trakt: %s\n", err)
+		return 1
+	}
+	fmt.Printf("Go to %s and enter the code %s\n", code.VerificationURL, code.UserCode)
+	result, err := traktSrv.PollDeviceToken(code)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Authorization failed: %s\n", err)
+		return 1
+	}
+	user := store.NewUser(username, result["access_token"].(string), result["refresh_token"].(string), trakt.TokenExpiry(result), storage)
+	fmt.Printf("Authorized %s\n\nWebhook link: %s\nSettings page: %s\n", username, webhookURL(*root, user), settingsURL(*root, user))
+	return 0
+}
+
+// webhookURL builds the link to paste in the Plex settings
+func webhookURL(root string, user store.User) string {
+	if user.Secret == "" {
+		return fmt.Sprintf("%s/api?id=%s", root, user.ID)
+	}
+	return fmt.Sprintf("%s/api?id=%s&secret=%s", root, user.ID, user.Secret)
+}
+
+func settingsURL(root string, user store.User) string {
+	return fmt.Sprintf("%s/settings?id=%s&secret=%s", root, user.ID, user.Secret)
+}
+
+// relinkURLs are the links authorizing a user again through a redirect or a code, keeping their webhook link.
+// They share a state, only one of them can be used.
+func relinkURLs(root string, user store.User) (string, string) {
+	state := newRelinkState(user)
+	redirect := url.Values{
+		"client_id":     {config.TraktClientId},
+		"redirect_uri":  {fmt.Sprintf("%s/authorize?username=%s", root, url.PathEscape(user.Username))},
+		"response_type": {"code"},
+		"state":         {state},
+	}
+	device := url.Values{
+		"username": {user.Username},
+		"state":    {state},
+	}
+	return "https://trakt.tv/oauth/authorize?" + redirect.Encode(), fmt.Sprintf("%s/device?%s", root, device.Encode())
+}
+
+// settings shows and saves the preferences of a user
+func settings(w http.ResponseWriter, r *http.Request) {
+	user := storage.GetUser(r.URL.Query().Get("id"))
+	if user == nil || !user.VerifySecret(r.URL.Query().Get("secret")) {
+		writeError(w, http.StatusForbidden, "id is invalid")
+		return
+	}
+	if secretRequired(w, r, *user) {
+		return
+	}
+	data := SettingsPage{
+		SelfRoot:         SelfRoot(r),
+		Action:           settingsURL(SelfRoot(r), *user),
+		UnlinkURL:        fmt.Sprintf("%s/unlink?id=%s&secret=%s", SelfRoot(r), user.ID, user.Secret),
+		Username:         user.Username,
+		DefaultThreshold: int(config.ProgressThreshold),
+		Filters:          store.FormatFilters(user.Filters),
+		Settings:         user.Settings,
+	}
+	if user.NeedsReauth {
+		data.RelinkURL, data.RelinkDeviceURL = relinkURLs(SelfRoot(r), *user)
+	}
+	if r.Method == http.MethodPost {
+		settings, err := parseSettings(r)
+		if err != nil {
+			data.Filters = r.FormValue("filters")
+			data.Error = err.Error()
+			w.WriteHeader(http.StatusBadRequest)
+		} else {
+			user.UpdateSettings(settings)
+			log.Print(fmt.Sprintf("Updated settings of %s", store.RedactID(user.ID)))
+			data.Settings = settings
+			data.Saved = true
+		}
+	}
+	tmpl := template.Must(template.ParseFiles("static/settings.html"))
+	_ = tmpl.Execute(w, data)
+}
+
+func parseSettings(r *http.Request) (store.Settings, error) {
+	var settings store.Settings
+	var err error
+	settings.Filters, err = store.ParseFilters(r.FormValue("filters"))
+	if err != nil {
+		return settings, err
+	}
+	settings.MovieThreshold, err = parseThreshold(r.FormValue("movie_threshold"))
+	if err != nil {
+		return settings, err
+	}
+	settings.EpisodeThreshold, err = parseThreshold(r.FormValue("episode_threshold"))
+	if err != nil {
+		return settings, err
+	}
+	settings.PlexURL = strings.TrimRight(strings.TrimSpace(r.FormValue("plex_url")), "/")
+	settings.PlexToken = strings.TrimSpace(r.FormValue("plex_token"))
+	settings.WatchedSync = r.FormValue("watched_sync") != ""
+	if settings.WatchedSync && (settings.PlexURL == "" || settings.PlexToken == "") {
+		return settings, fmt.Errorf("watched sync needs the Plex server URL and token")
+	}
+	settings.CollectionSync = r.FormValue("collection_sync") != ""
+	settings.WatchlistCleanup = r.FormValue("watchlist_cleanup") != ""
+	settings.Mode = r.FormValue("mode")
+	if settings.Mode != "" && settings.Mode != store.ModeScrobble && settings.Mode != store.ModeCheckin {
+		return settings, fmt.Errorf("invalid mode %q", settings.Mode)
+	}
+	return settings, nil
+}
+
+// parseThreshold reads a percentage, empty means the instance default
+func parseThreshold(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	threshold, err := strconv.Atoi(value)
+	if err != nil || threshold < trakt.MinProgressThreshold || threshold > 100 {
+		return 0, fmt.Errorf("invalid threshold %q, expected a percentage between %d and 100", value, trakt.MinProgressThreshold)
+	}
+	return threshold, nil
+}
+
+// rotate replaces the secret of a user, the previous webhook links stop working
+func rotate(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get("id")
+	user := storage.GetUser(id)
+	if user == nil || !user.VerifySecret(r.URL.Query().Get("secret")) {
+		writeError(w, http.StatusForbidden, "id is invalid")
+		return
+	}
+	if secretRequired(w, r, *user) {
+		return
+	}
+	user.RotateSecret()
+	log.Print(fmt.Sprintf("Rotated secret of %s", store.RedactID(user.ID)))
+	json.NewEncoder(w).Encode(map[string]string{
+		"url":          webhookURL(SelfRoot(r), *user),
+		"settings_url": settingsURL(SelfRoot(r), *user),
+	})
+}
+
+// unlink revokes the Trakt authorization of a user and deletes everything stored about them
+func unlink(w http.ResponseWriter, r *http.Request) {
+	user := storage.GetUser(r.URL.Query().Get("id"))
+	if user == nil || !user.VerifySecret(r.URL.Query().Get("secret")) {
+		writeError(w, http.StatusForbidden, "id is invalid")
+		return
+	}
+	if secretRequired(w, r, *user) {
+		return
+	}
+	// the tokens of a user who has to authorize again are already invalid
+	if !user.NeedsReauth {
+		if err := traktSrv.RevokeToken(user.AccessToken); err != nil {
+			log.Printf("Revoking the tokens of %s failed: %s", store.RedactID(user.ID), err)
+			writeError(w, http.StatusBadGateway, "revoking the Trakt authorization failed")
+			return
+		}
+	}
+	if !storage.DeleteUser(user.ID, user.Username) {
+		writeError(w, http.StatusInternalServerError, "deleting the user failed")
+		return
+	}
+	log.Print(fmt.Sprintf("Unlinked %s", store.RedactID(user.ID)))
+	http.Redirect(w, r, SelfRoot(r), http.StatusSeeOther)
+}
+
 func api(w http.ResponseWriter, r *http.Request) {
 	id := r.URL.Query().Get("id")
 	if id == "" {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "missing id")
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, config.MaxWebhookSize)
+	re, err := hooks.ParsePlex(r)
+	if err != nil {
+		writeParseError(w, err)
+		return
+	}
+	handleWebhook(w, r, re)
+}
+
+func jellyfinApi(w http.ResponseWriter, r *http.Request) {
+	parseAndHandle(w, r, hooks.ParseJellyfin)
+}
+
+func tautulliApi(w http.ResponseWriter, r *http.Request) {
+	parseAndHandle(w, r, hooks.ParseTautulli)
+}
+
+func embyApi(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		// Emby sends the JSON in the data field unless "application/json" is selected
+		r.Body = http.MaxBytesReader(w, r.Body, config.MaxWebhookSize)
+		if err := r.ParseMultipartForm(config.MaxWebhookSize); err != nil {
+			writeParseError(w, err)
+			return
+		}
+		r.Body = io.NopCloser(strings.NewReader(r.FormValue("data")))
+	}
+	parseAndHandle(w, r, hooks.ParseEmby)
+}
+
+// parseAndHandle reads a JSON webhook and translates it with parse before handling it
+func parseAndHandle(w http.ResponseWriter, r *http.Request, parse func([]byte) (hooks.Webhook, error)) {
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		writeError(w, http.StatusBadRequest, "missing id")
 		return
 	}
-	body, err := io.ReadAll(r.Body)
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, config.MaxWebhookSize))
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeParseError(w, err)
 		return
 	}
-	regex := regexp.MustCompile("({.*})") // not the best way really
-	match := regex.FindStringSubmatch(string(body))
-	re, err := plexhooks.ParseWebhook([]byte(match[0]))
+	re, err := parse(body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeParseError(w, err)
 		return
 	}
+	handleWebhook(w, r, re)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(errorResponse{Error: message})
+}
+
+func writeParseError(w http.ResponseWriter, err error) {
+	if strings.Contains(err.Error(), "request body too large") {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("body exceeds %d bytes", config.MaxWebhookSize))
+		return
+	}
+	writeError(w, http.StatusBadRequest, err.Error())
+}
+
+// handleWebhook scrobbles a webhook translated to the Plex format
+func handleWebhook(w http.ResponseWriter, r *http.Request, re hooks.Webhook) {
+	id := r.URL.Query().Get("id")
+	secret := r.URL.Query().Get("secret")
+	lastRoot.Store(SelfRoot(r))
 	username := strings.ToLower(re.Account.Title)
-	log.Print(fmt.Sprintf("Webhook call for %s (%s)", id, re.Account.Title))
+	log.Print(fmt.Sprintf("Webhook call for %s (%s)", store.RedactID(id), re.Account.Title))
 
 	// Handle the requests of the same user one at a time
-	key := fmt.Sprintf("%s@%s", username, id)
+	key := fmt.Sprintf("%s@%s:%s", username, id, secret)
 	userInf, err, _ := apiSf.Do(key, func() (interface{}, error) {
 		user := storage.GetUser(id)
 		if user == nil {
 			log.Println("id is invalid")
 			return nil, trakt.NewHttpError(http.StatusForbidden, "id is invalid")
 		}
+		if !user.VerifySecret(secret) {
+			log.Println("secret is invalid")
+			return nil, trakt.NewHttpError(http.StatusForbidden, "id is invalid")
+		}
 		if re.Owner && username != user.Username {
 			user = storage.GetUserByName(username)
+			// the secret of the link has to be the one of the account played on as well
+			if user != nil && !user.VerifySecret(secret) {
+				log.Printf("secret is invalid for %s", username)
+				return nil, trakt.NewHttpError(http.StatusForbidden, "id is invalid")
+			}
 		}
 
 		if user == nil {
@@ -117,24 +676,23 @@ func api(w http.ResponseWriter, r *http.Request) {
 			return nil, trakt.NewHttpError(http.StatusNotFound, "user not found")
 		}
 
-		tokenAge := time.Since(user.Updated).Hours()
-		if tokenAge > 23 { // tokens expire after 24 hours, so we refresh after 23
-			log.Println("User access token outdated, refreshing...")
-			result, success := traktSrv.AuthRequest(SelfRoot(r), user.Username, "", user.RefreshToken, "refresh_token")
-			if success {
-				user.UpdateUser(result["access_token"].(string), result["refresh_token"].(string))
-				log.Println("Refreshed, continuing")
-			} else {
-				log.Println("Refresh failed, skipping and deleting user")
-				storage.DeleteUser(user.ID, user.Username)
-				return nil, trakt.NewHttpError(http.StatusUnauthorized, "fail")
+		if !user.NeedsReauth && user.NeedsRefresh(0) {
+			// the background refresher is late, the expired token would be refused
+			log.Println("User access token expired, refreshing it")
+			refreshed, err := refreshUser(*user)
+			if err != nil {
+				return nil, trakt.NewHttpError(http.StatusBadGateway, "cannot refresh the access token")
 			}
+			user = &refreshed
+		}
+		if user.NeedsReauth {
+			log.Println("User has to authorize again")
+			return nil, trakt.NewHttpError(http.StatusUnauthorized, "needs re-authorization")
 		}
 		return user, nil
 	})
 	if err != nil {
-		w.WriteHeader(err.(trakt.HttpError).Code)
-		json.NewEncoder(w).Encode(err.Error())
+		writeError(w, err.(trakt.HttpError).Code, err.Error())
 		return
 	}
 	user := userInf.(*store.User)
@@ -149,6 +707,66 @@ func api(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode("success")
 }
 
+// runTokenRefresh refreshes the access tokens expiring soon now and every interval, it never returns
+func runTokenRefresh(interval time.Duration) {
+	common.Safely("Token refresh", refreshTokens)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		common.Safely("Token refresh", refreshTokens)
+	}
+}
+
+// refreshTokens refreshes the access tokens expiring soon. Without PUBLIC_URL
+// it waits for a request to tell the address of the instance, a wrong
+// redirect URI would get the refreshes rejected.
+func refreshTokens() {
+	if refreshRoot() == "" {
+		log.Print("Token refresh skipped until a request tells the address of this instance, set PUBLIC_URL to refresh right away")
+		return
+	}
+	for _, user := range storage.ListUsers() {
+		if !user.NeedsReauth && user.NeedsRefresh(refreshMargin) {
+			_, _ = refreshUser(user)
+		}
+	}
+}
+
+// refreshRoot is the address of the instance sent along the refreshes
+func refreshRoot() string {
+	if config.PublicURL != "" {
+		return config.PublicURL
+	}
+	root, _ := lastRoot.Load().(string)
+	return root
+}
+
+// refreshUser refreshes the access token of a user, once at a time, and
+// returns the user updated
+func refreshUser(user store.User) (store.User, error) {
+	refreshed, err, _ := refreshSf.Do(user.ID, func() (interface{}, error) {
+		root := refreshRoot()
+		log.Printf("Refreshing the access token of %s", store.RedactID(user.ID))
+		result, err := traktSrv.AuthRequest(root, user.Username, "", user.RefreshToken, "refresh_token")
+		if trakt.RevokedGrant(err) {
+			log.Printf("Refresh of %s rejected (%s), it has to authorize again", store.RedactID(user.ID), err)
+			user.RequireReauth()
+			return user, nil
+		} else if err != nil {
+			// the refresher tries again on its next run
+			log.Printf("Refresh of %s failed, retrying later: %s", store.RedactID(user.ID), err)
+			return nil, err
+		}
+		user.UpdateUser(result["access_token"].(string), result["refresh_token"].(string), trakt.TokenExpiry(result))
+		log.Printf("Refreshed the access token of %s", store.RedactID(user.ID))
+		return user, nil
+	})
+	if err != nil {
+		return user, err
+	}
+	return refreshed.(store.User), nil
+}
+
 func allowedHostsHandler(allowedHostnames string) func(http.Handler) http.Handler {
 	allowedHosts := strings.Split(regexp.MustCompile("https://|http://|\\s+").ReplaceAllString(strings.ToLower(allowedHostnames), ""), ",")
 	log.Println("Allowed Hostnames:", allowedHosts)
@@ -185,6 +803,12 @@ func healthcheckHandler() http.Handler {
 		healthcheck.WithChecker("storage", healthcheck.CheckerFunc(func(ctx context.Context) error {
 			return storage.Ping(ctx)
 		})),
+		healthcheck.WithObserver("scrobble_queue", healthcheck.CheckerFunc(func(ctx context.Context) error {
+			return trakt.QueueStatus(storage.GetScrobbleQueue())
+		})),
+		healthcheck.WithObserver("trakt_rate_limit", healthcheck.CheckerFunc(func(ctx context.Context) error {
+			return traktSrv.RateLimitStatus()
+		})),
 	)
 }
 
@@ -204,7 +828,38 @@ func main() {
 		log.Println("Using disk storage:")
 	}
 	apiSf = &singleflight.Group{}
-	traktSrv = trakt.New(config.TraktClientId, config.TraktClientSecret, storage)
+	srv := trakt.New(config.TraktClientId, config.TraktClientSecret, storage)
+	if config.ProgressThreshold < trakt.MinProgressThreshold || config.ProgressThreshold > 100 {
+		log.Fatalf("PROGRESS_THRESHOLD must be between %d and 100, Trakt records the stops below %d%% as pauses",
+			trakt.MinProgressThreshold, trakt.MinProgressThreshold)
+	}
+	srv.ProgressThreshold = int(config.ProgressThreshold)
+	if config.TraktAPIURL != "" {
+		srv.BaseURL = config.TraktAPIURL
+	}
+	srv.ResolvePlexGuids = config.ResolvePlexGuids
+	srv.PlexToken = config.PlexToken
+	if config.AnimeListPath != "" {
+		list, err := animelist.Load(config.AnimeListPath)
+		if err != nil {
+			panic(err)
+		}
+		log.Printf("Loaded the anime list, %d series", list.Len())
+		srv.AnimeList = list
+		go list.RunReload(time.Minute)
+	}
+	traktSrv = srv
+	if len(os.Args) > 1 && os.Args[1] == "authorize" {
+		os.Exit(authorizeCommand(os.Args[2:]))
+	}
+	go srv.RunRetryQueue(time.Minute)
+	go runTokenRefresh(10 * time.Minute)
+	if config.WatchedSyncInterval > 0 {
+		go srv.RunWatchedSync(time.Duration(config.WatchedSyncInterval) * time.Minute)
+	}
+	if config.CollectionSyncInterval > 0 {
+		go srv.RunCollectionSync(time.Duration(config.CollectionSyncInterval) * time.Minute)
+	}
 
 	router := mux.NewRouter()
 	// Assumption: Behind a proper web server (nginx/traefik, etc) that removes/replaces trusted headers
@@ -219,7 +874,14 @@ func main() {
 		router.Use(allowedHostsHandler(os.Getenv("ALLOWED_HOSTNAMES")))
 	}
 	router.HandleFunc("/authorize", authorize).Methods("GET")
+	router.HandleFunc("/device", device).Methods("GET", "POST")
 	router.HandleFunc("/api", api).Methods("POST")
+	router.HandleFunc("/rotate", rotate).Methods("POST")
+	router.HandleFunc("/unlink", unlink).Methods("POST")
+	router.HandleFunc("/settings", settings).Methods("GET", "POST")
+	router.HandleFunc("/api/jellyfin", jellyfinApi).Methods("POST")
+	router.HandleFunc("/api/emby", embyApi).Methods("POST")
+	router.HandleFunc("/api/tautulli", tautulliApi).Methods("POST")
 	router.Handle("/healthcheck", healthcheckHandler()).Methods("GET")
 	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		tmpl := template.Must(template.ParseFiles("static/index.html"))
@@ -227,7 +889,7 @@ func main() {
 			SelfRoot:   SelfRoot(r),
 			Authorized: false,
 			URL:        "https://plaxt.royxiang.me/api?id=generate-your-own-silly",
-			ClientID:   traktSrv.ClientId,
+			ClientID:   config.TraktClientId,
 		}
 		_ = tmpl.Execute(w, data)
 	}).Methods("GET")
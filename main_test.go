@@ -3,15 +3,26 @@ package main
 import (
 	"github.com/gorilla/handlers"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/singleflight"
 
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"mime/multipart"
 
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/xanderstrike/goplaxt/lib/common"
+	"github.com/xanderstrike/goplaxt/lib/hooks"
 	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt"
+	"github.com/xanderstrike/goplaxt/lib/trakt/trakttest"
 )
 
 func TestSelfRoot(t *testing.T) {
@@ -90,6 +101,7 @@ func TestAllowedHostsHandler_mismatch_hostname(t *testing.T) {
 
 func TestAllowedHostsHandler_alwaysAllowHealthcheck(t *testing.T) {
 	storage = &MockSuccessStore{}
+	traktSrv = &MockTrakt{}
 	f := allowedHostsHandler("unknown.host")
 
 	rr := httptest.NewRecorder()
@@ -105,17 +117,120 @@ func TestAllowedHostsHandler_alwaysAllowHealthcheck(t *testing.T) {
 
 type MockSuccessStore struct{}
 
-func (s MockSuccessStore) Ping(ctx context.Context) error { return nil }
-func (s MockSuccessStore) WriteUser(user store.User)      {}
-func (s MockSuccessStore) GetUser(id string) *store.User  { return nil }
-func (s MockSuccessStore) DeleteUser(id string) bool      { return true }
+func (s MockSuccessStore) Ping(ctx context.Context) error            { return nil }
+func (s MockSuccessStore) WriteUser(user store.User)                 {}
+func (s MockSuccessStore) GetUser(id string) *store.User             { return nil }
+func (s MockSuccessStore) GetUserByName(username string) *store.User { return nil }
+func (s MockSuccessStore) ListUsers() []store.User                   { return nil }
+func (s MockSuccessStore) DeleteUser(id, username string) bool       { return true }
+func (s MockSuccessStore) WriteScrobbleBody(item common.CacheItem)   {}
+func (s MockSuccessStore) EnqueueScrobble(item common.QueueItem)     {}
+func (s MockSuccessStore) GetScrobbleQueue() []common.QueueItem      { return nil }
+func (s MockSuccessStore) DequeueScrobble(id string)                 {}
+func (s MockSuccessStore) GetScrobbleBody(playerUuid, ratingKey string) common.CacheItem {
+	return common.CacheItem{}
+}
 
 type MockFailStore struct{}
 
-func (s MockFailStore) Ping(ctx context.Context) error { return errors.New("OH NO") }
-func (s MockFailStore) WriteUser(user store.User)      { panic(errors.New("OH NO")) }
-func (s MockFailStore) GetUser(id string) *store.User  { panic(errors.New("OH NO")) }
-func (s MockFailStore) DeleteUser(id string) bool      { return false }
+func (s MockFailStore) Ping(ctx context.Context) error            { return errors.New("OH NO") }
+func (s MockFailStore) WriteUser(user store.User)                 { panic(errors.New("OH NO")) }
+func (s MockFailStore) GetUser(id string) *store.User             { panic(errors.New("OH NO")) }
+func (s MockFailStore) GetUserByName(username string) *store.User { panic(errors.New("OH NO")) }
+func (s MockFailStore) ListUsers() []store.User                   { panic(errors.New("OH NO")) }
+func (s MockFailStore) DeleteUser(id, username string) bool       { return false }
+func (s MockFailStore) WriteScrobbleBody(item common.CacheItem)   { panic(errors.New("OH NO")) }
+func (s MockFailStore) EnqueueScrobble(item common.QueueItem)     { panic(errors.New("OH NO")) }
+func (s MockFailStore) GetScrobbleQueue() []common.QueueItem      { return nil }
+func (s MockFailStore) DequeueScrobble(id string)                 {}
+func (s MockFailStore) GetScrobbleBody(playerUuid, ratingKey string) common.CacheItem {
+	panic(errors.New("OH NO"))
+}
+
+type MockQueueStore struct {
+	MockSuccessStore
+}
+
+func (s MockQueueStore) GetScrobbleQueue() []common.QueueItem {
+	return []common.QueueItem{
+		{ID: "a", LastError: "status code: 502", Updated: time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC)},
+		{ID: "b", LastError: "status code: 503", Updated: time.Date(2019, 02, 26, 0, 0, 0, 0, time.UTC)},
+	}
+}
+
+type MockTrakt struct {
+	rateLimit error
+	slugs     map[string]string
+}
+
+func (m MockTrakt) Handle(wh hooks.Webhook, user store.User) {}
+func (m MockTrakt) RateLimitStatus() error                   { return m.rateLimit }
+func (m MockTrakt) AuthRequest(root, username, code, refreshToken, grantType string) (map[string]interface{}, error) {
+	return nil, errors.New("not implemented")
+}
+func (m MockTrakt) RevokeToken(accessToken string) error { return errors.New("not implemented") }
+func (m MockTrakt) UserSlug(accessToken string) (string, error) {
+	if slug, ok := m.slugs[accessToken]; ok {
+		return slug, nil
+	}
+	return "", errors.New("not found")
+}
+func (m MockTrakt) RequestDeviceCode() (trakt.DeviceCode, error) {
+	return trakt.DeviceCode{}, errors.New("not implemented")
+}
+func (m MockTrakt) PollDeviceToken(code trakt.DeviceCode) (map[string]interface{}, error) {
+	return nil, errors.New("not implemented")
+}
+
+type MockUserStore struct {
+	MockSuccessStore
+	user store.User
+}
+
+func (s MockUserStore) GetUser(id string) *store.User {
+	if id != s.user.ID {
+		return nil
+	}
+	user := s.user
+	return &user
+}
+
+type MockUsersStore struct {
+	MockSuccessStore
+	users []store.User
+}
+
+func (s MockUsersStore) GetUser(id string) *store.User {
+	for _, user := range s.users {
+		if user.ID == id {
+			return &user
+		}
+	}
+	return nil
+}
+
+func (s MockUsersStore) GetUserByName(username string) *store.User {
+	for _, user := range s.users {
+		if user.Username == username {
+			return &user
+		}
+	}
+	return nil
+}
+
+func (s MockUsersStore) ListUsers() []store.User {
+	return s.users
+}
+
+type MockDeleteStore struct {
+	MockUserStore
+	deleted []string
+}
+
+func (s *MockDeleteStore) DeleteUser(id, username string) bool {
+	s.deleted = append(s.deleted, id)
+	return true
+}
 
 func TestHealthcheck(t *testing.T) {
 	var rr *httptest.ResponseRecorder
@@ -126,6 +241,7 @@ func TestHealthcheck(t *testing.T) {
 	}
 
 	storage = &MockSuccessStore{}
+	traktSrv = &MockTrakt{}
 	rr = httptest.NewRecorder()
 	http.Handler(healthcheckHandler()).ServeHTTP(rr, r)
 	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
@@ -136,4 +252,397 @@ func TestHealthcheck(t *testing.T) {
 	http.Handler(healthcheckHandler()).ServeHTTP(rr, r)
 	assert.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
 	assert.Equal(t, "{\"status\":\"Service Unavailable\",\"errors\":{\"storage\":\"OH NO\"}}\n", rr.Body.String())
+
+	storage = &MockQueueStore{}
+	rr = httptest.NewRecorder()
+	http.Handler(healthcheckHandler()).ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Equal(t, "{\"status\":\"OK\",\"errors\":{\"scrobble_queue\":\"2 scrobbles queued, last error: status code: 503\"}}\n", rr.Body.String())
+
+	storage = &MockSuccessStore{}
+	traktSrv = &MockTrakt{rateLimit: errors.New("12 of 1000 calls left")}
+	rr = httptest.NewRecorder()
+	http.Handler(healthcheckHandler()).ServeHTTP(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Equal(t, "{\"status\":\"OK\",\"errors\":{\"trakt_rate_limit\":\"12 of 1000 calls left\"}}\n", rr.Body.String())
+}
+
+func TestApiBadRequest(t *testing.T) {
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "/api?id=id123", strings.NewReader("not a webhook"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "text/plain")
+	api(rr, r)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	assert.Equal(t, "{\"error\":\"expected a multipart/form-data request\"}\n", rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest("POST", "/api", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api(rr, r)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	assert.Equal(t, "{\"error\":\"missing id\"}\n", rr.Body.String())
+}
+
+func TestApiScrobble(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	storage = &MockUserStore{user: store.User{
+		ID:          "id123",
+		Username:    "halkeye",
+		AccessToken: "access123",
+		Secret:      "secret123",
+		Updated:     time.Now(),
+	}}
+	srv := trakt.New("id", "secret", storage)
+	srv.BaseURL = server.URL
+	traktSrv = srv
+	apiSf = &singleflight.Group{}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("payload", `{
+		"event": "media.play",
+		"Account": {"title": "halkeye"},
+		"Server": {"uuid": "server1"},
+		"Player": {"uuid": "player1"},
+		"Metadata": {"librarySectionType": "movie", "ratingKey": "42", "Guid": [{"id": "tmdb://603"}], "viewOffset": 0, "duration": 100}
+	}`)
+	_ = writer.Close()
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "/api?id=id123&secret=secret123", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	api(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	calls := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, calls, 1)
+	assert.Equal(t, "access123", calls[0].AccessToken)
+	assert.JSONEq(t, `{"progress":0,"movie":{"ids":{"tmdb":603}}}`, string(calls[0].Body))
+}
+
+func TestApiRefreshExpired(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	users := &MockUsersStore{}
+	user := store.NewUser("halkeye", "access0", "refresh0", time.Now().Add(-time.Minute), users)
+	users.users = []store.User{user}
+	storage = users
+	srv := trakt.New("id", "secret", storage)
+	srv.BaseURL = server.URL
+	traktSrv = srv
+	apiSf = &singleflight.Group{}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("payload", `{
+		"event": "media.play",
+		"Account": {"title": "halkeye"},
+		"Player": {"uuid": "player1"},
+		"Metadata": {"librarySectionType": "movie", "ratingKey": "42", "Guid": [{"id": "tmdb://603"}], "viewOffset": 0, "duration": 100}
+	}`)
+	_ = writer.Close()
+	r, err := http.NewRequest("POST", fmt.Sprintf("/api?id=%s&secret=%s", user.ID, user.Secret), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	api(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	refreshes := server.CallsTo(http.MethodPost, "/oauth/token")
+	assert.Len(t, refreshes, 1)
+	assert.Contains(t, string(refreshes[0].Body), `"refresh_token":"refresh0"`)
+	starts := server.CallsTo(http.MethodPost, "/scrobble/start")
+	assert.Len(t, starts, 1)
+	assert.Equal(t, "access1", starts[0].AccessToken)
+}
+
+func TestRefreshTokensUnknownRoot(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	users := &MockUsersStore{}
+	user := store.NewUser("halkeye", "access0", "refresh0", time.Now().Add(time.Minute), users)
+	users.users = []store.User{user}
+	storage = users
+	srv := trakt.New("id", "secret", storage)
+	srv.BaseURL = server.URL
+	traktSrv = srv
+	lastRoot.Store("")
+	defer lastRoot.Store("")
+
+	refreshTokens()
+	assert.Empty(t, server.CallsTo(http.MethodPost, "/oauth/token"))
+
+	lastRoot.Store("http://localhost")
+	refreshTokens()
+	refreshes := server.CallsTo(http.MethodPost, "/oauth/token")
+	assert.Len(t, refreshes, 1)
+	assert.Contains(t, string(refreshes[0].Body), `"redirect_uri":"http://localhost/authorize`)
+}
+
+func TestDevice(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	storage = &MockSuccessStore{}
+	srv := trakt.New("id", "secret", storage)
+	srv.BaseURL = server.URL
+	traktSrv = srv
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/device?username=Halkeye", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device(rr, r)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest("POST", "/device", strings.NewReader("username=Halkeye"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	device(rr, r)
+	assert.Equal(t, http.StatusSeeOther, rr.Result().StatusCode)
+	location, _ := rr.Result().Location()
+	assert.NotEmpty(t, location.Query().Get("session"))
+
+	r, err = http.NewRequest("GET", location.String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	device(rr, r)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "ABCD1234")
+
+	assert.Eventually(t, func() bool {
+		rr = httptest.NewRecorder()
+		device(rr, r)
+		return strings.Contains(rr.Body.String(), "/api?id=")
+	}, 5*time.Second, 100*time.Millisecond)
+	assert.Len(t, server.CallsTo(http.MethodPost, "/oauth/device/token"), 1)
+}
+
+func TestDeviceLimits(t *testing.T) {
+	deviceSessions = make(map[string]*deviceSession)
+	defer func() { deviceSessions = make(map[string]*deviceSession) }()
+
+	id, started, err := reserveDeviceSession("halkeye", "")
+	assert.Nil(t, err)
+	assert.True(t, started)
+	reused, started, err := reserveDeviceSession("halkeye", "")
+	assert.Nil(t, err)
+	assert.False(t, started)
+	assert.Equal(t, id, reused)
+
+	for _, state := range []string{"state1", "state2"} {
+		_, _, err = reserveDeviceSession("halkeye", state)
+		assert.Nil(t, err)
+	}
+	_, _, err = reserveDeviceSession("halkeye", "state3")
+	assert.NotNil(t, err)
+	// the ended sessions don't count
+	deviceSessions[id].Error = "expired"
+	_, _, err = reserveDeviceSession("halkeye", "state3")
+	assert.Nil(t, err)
+
+	// three of halkeye's sessions are pending
+	for i := 3; i < maxDeviceSessions; i++ {
+		_, _, err = reserveDeviceSession(fmt.Sprintf("user%d", i), "")
+		assert.Nil(t, err)
+	}
+	_, _, err = reserveDeviceSession("someone", "")
+	assert.NotNil(t, err)
+}
+
+func TestApiNeedsReauth(t *testing.T) {
+	storage = &MockUserStore{user: store.User{
+		ID:          "id123",
+		Username:    "halkeye",
+		Secret:      "secret123",
+		Updated:     time.Now(),
+		NeedsReauth: true,
+	}}
+	traktSrv = &MockTrakt{}
+	apiSf = &singleflight.Group{}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("payload", `{"event": "media.play", "Account": {"title": "halkeye"}}`)
+	_ = writer.Close()
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "/api?id=id123&secret=secret123", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	api(rr, r)
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Result().StatusCode)
+	assert.Equal(t, "{\"error\":\"needs re-authorization\"}\n", rr.Body.String())
+}
+
+func TestApiOwnerSwitch(t *testing.T) {
+	storage = &MockUsersStore{users: []store.User{
+		{ID: "id123", Username: "halkeye", Secret: "secret123", Updated: time.Now()},
+		{ID: "id456", Username: "family", Secret: "secret456", Updated: time.Now()},
+		{ID: "id789", Username: "legacy", Updated: time.Now()},
+	}}
+	traktSrv = &MockTrakt{}
+	apiSf = &singleflight.Group{}
+	post := func(account string) *httptest.ResponseRecorder {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		_ = writer.WriteField("payload", fmt.Sprintf(`{"event": "media.play", "owner": true, "Account": {"title": %q}}`, account))
+		_ = writer.Close()
+		r, err := http.NewRequest("POST", "/api?id=id123&secret=secret123", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		api(rr, r)
+		return rr
+	}
+
+	rr := post("family")
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+	assert.Equal(t, "{\"error\":\"id is invalid\"}\n", rr.Body.String())
+	assert.Equal(t, http.StatusOK, post("legacy").Result().StatusCode)
+	assert.Equal(t, http.StatusNotFound, post("stranger").Result().StatusCode)
+}
+
+func TestRelink(t *testing.T) {
+	users := &MockUsersStore{}
+	user := store.NewUser("halkeye", "access123", "refresh123", time.Now(), users)
+	users.users = []store.User{user}
+	storage = users
+
+	redirect, device := relinkURLs("http://localhost", user)
+	assert.NotContains(t, redirect, user.Secret)
+	assert.NotContains(t, device, user.Secret)
+	location, err := url.Parse(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	assert.Contains(t, redirect, "state="+state)
+
+	linked, err := linkUser("halkeye", state, map[string]interface{}{"access_token": "access456"})
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, linked.ID)
+	assert.Equal(t, "access456", linked.AccessToken)
+
+	_, err = linkUser("halkeye", state, map[string]interface{}{"access_token": "access789"})
+	assert.NotNil(t, err)
+	_, err = linkUser("halkeye", user.ID+":"+user.Secret, map[string]interface{}{"access_token": "access789"})
+	assert.NotNil(t, err)
+}
+
+func TestLegacySecret(t *testing.T) {
+	users := &MockUsersStore{}
+	user := store.NewUser("halkeye", "access123", "refresh123", time.Now().Add(time.Hour), users)
+	user.Secret = ""
+	users.users = []store.User{user}
+	storage = users
+	traktSrv = &MockTrakt{slugs: map[string]string{"access123": "halkeye", "access456": "mallory", "access789": "halkeye"}}
+
+	for _, handler := range []func(http.ResponseWriter, *http.Request){rotate, unlink} {
+		rr := httptest.NewRecorder()
+		r, err := http.NewRequest("POST", "/?id="+user.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		handler(rr, r)
+		assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+		assert.Contains(t, rr.Body.String(), "authorize again to get one: https://trakt.tv/oauth/authorize?")
+	}
+	relink := func() string {
+		rr := httptest.NewRecorder()
+		r, err := http.NewRequest("GET", "/settings?id="+user.ID, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings(rr, r)
+		assert.Equal(t, http.StatusSeeOther, rr.Result().StatusCode)
+		location, _ := rr.Result().Location()
+		assert.Equal(t, "trakt.tv", location.Host)
+		return location.Query().Get("state")
+	}
+
+	// anyone knowing the id can start it, not with another Trakt account
+	_, err := linkUser("halkeye", relink(), map[string]interface{}{"access_token": "access456"})
+	assert.NotNil(t, err)
+	linked, err := linkUser("halkeye", relink(), map[string]interface{}{"access_token": "access789"})
+	assert.Nil(t, err)
+	assert.Equal(t, user.ID, linked.ID)
+	assert.NotEmpty(t, linked.Secret)
+}
+
+func TestUnlink(t *testing.T) {
+	server := trakttest.NewServer()
+	defer server.Close()
+	deleteStore := &MockDeleteStore{MockUserStore: MockUserStore{user: store.User{
+		ID:          "id123",
+		Username:    "halkeye",
+		AccessToken: "access123",
+		Secret:      "secret123",
+	}}}
+	storage = deleteStore
+	srv := trakt.New("id", "secret", storage)
+	srv.BaseURL = server.URL
+	traktSrv = srv
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("POST", "/unlink?id=id123&secret=wrong", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlink(rr, r)
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+	assert.Empty(t, server.Calls())
+
+	server.Respond(http.MethodPost, "/oauth/revoke", http.StatusServiceUnavailable, nil)
+	rr = httptest.NewRecorder()
+	r, err = http.NewRequest("POST", "/unlink?id=id123&secret=secret123", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlink(rr, r)
+	assert.Equal(t, http.StatusBadGateway, rr.Result().StatusCode)
+	assert.Empty(t, deleteStore.deleted)
+
+	server.Reset()
+	rr = httptest.NewRecorder()
+	unlink(rr, r)
+	assert.Equal(t, http.StatusSeeOther, rr.Result().StatusCode)
+	assert.Equal(t, []string{"id123"}, deleteStore.deleted)
+	calls := server.CallsTo(http.MethodPost, "/oauth/revoke")
+	assert.Len(t, calls, 1)
+	assert.Contains(t, string(calls[0].Body), `"token":"access123"`)
+}
+
+func TestParseThreshold(t *testing.T) {
+	threshold, err := parseThreshold("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, threshold)
+	threshold, err = parseThreshold("85")
+	assert.NoError(t, err)
+	assert.Equal(t, 85, threshold)
+
+	// Trakt records the stops below 80% as pauses
+	_, err = parseThreshold("50")
+	assert.Error(t, err)
+	_, err = parseThreshold("101")
+	assert.Error(t, err)
 }